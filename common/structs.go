@@ -27,3 +27,11 @@ type ChiselConfig struct {
 	Password string `json:"password"`
 	Nodes    int    `json:"nodes"`
 }
+
+type Logout struct {
+	// Revoked tells whether the controller revoked the token, the local state is wiped either way
+	Revoked bool   `json:"revoked"`
+	Error   string `json:"error"`
+	// UserToken is set when the daemon used the user token, which is rotated in the web panel instead of revoked
+	UserToken bool `json:"user_token"`
+}
@@ -104,6 +104,33 @@ func main() {
 
 	var state common.State
 
+	if flag.Arg(0) == "logout" {
+		fmt.Println("Logging out")
+
+		resp, err := sockClient.Post("http://unix/logout", "text/plain", nil)
+		check(err)
+
+		defer resp.Body.Close()
+
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		var logout common.Logout
+		check(json.Unmarshal(respBytes, &logout))
+
+		if logout.Error != "" {
+			fmt.Printf("Failed to revoke the token on the controller, revoke it in the web interface: %s\n", logout.Error)
+		} else if logout.Revoked {
+			fmt.Println("Token revoked")
+		}
+		if logout.UserToken {
+			fmt.Println("Your user token still works, rotate it in the web panel if it may have leaked")
+		}
+
+		fmt.Println("Done")
+		os.Exit(0)
+	}
+
 	if fReset {
 		fmt.Println("Resetting config")
 		check(updateConfig(&state))
@@ -151,7 +178,7 @@ func main() {
 		}
 	}
 	for len(state.Token) == 0 {
-		fmt.Print("User token: ")
+		fmt.Print("User or API token: ")
 		confUpdate = true
 		state.Token, _ = reader.ReadString('\n')
 		state.Token = strings.TrimSpace(state.Token)
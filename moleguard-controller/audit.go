@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuditEntry struct {
+	Id       int64     `json:"id"`
+	At       time.Time `json:"at"`
+	UserId   int64     `json:"user_id,omitempty"`
+	Action   string    `json:"action"`
+	Node     string    `json:"node,omitempty"`
+	Device   int       `json:"device,omitempty"`
+	Relay    string    `json:"relay,omitempty"`
+	ClientIp string    `json:"client_ip"`
+	// Outcome is success, denied or failed
+	Outcome string `json:"outcome"`
+	Status  int    `json:"status"`
+}
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	// Next is passed as before to get the following page, it is 0 on the last page
+	Next int64 `json:"next,omitempty"`
+}
+
+type auditKey struct{}
+
+// auditEntry is the entry of the running request, handlers fill in what they
+// know about the device and relay that were changed
+func auditEntry(r *http.Request) *AuditEntry {
+	entry, ok := r.Context().Value(auditKey{}).(*AuditEntry)
+	if !ok {
+		return &AuditEntry{}
+	}
+	return entry
+}
+
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func outcome(status int) string {
+	switch {
+	case status < 400:
+		return "success"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	default:
+		return "failed"
+	}
+}
+
+// audited records the request in the audit log once it is done. It wraps
+// authMiddleware, which fills in the user, so denied requests are recorded
+// too. Handlers may set a denied outcome themselves.
+func audited(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &AuditEntry{
+			At:       time.Now(),
+			Action:   action,
+			Node:     r.PathValue("node"),
+			ClientIp: clientIp(r),
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			// handlers panic on unexpected errors, the request fails then
+			if v := recover(); v != nil {
+				entry.Status = http.StatusInternalServerError
+				entry.Outcome = ""
+				recordAudit(entry)
+				panic(v)
+			}
+
+			entry.Status = sw.status
+			recordAudit(entry)
+		}()
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+	})
+}
+
+func recordAudit(entry *AuditEntry) {
+	if entry.Outcome == "" {
+		entry.Outcome = outcome(entry.Status)
+	}
+
+	var userId sql.NullInt64
+	if entry.UserId != 0 {
+		userId = sql.NullInt64{Int64: entry.UserId, Valid: true}
+	}
+
+	_, err := db.Exec("insert into audit(created_at, user_id, action, node, device, relay, client_ip, outcome, status) values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.At.UnixMilli(), userId, entry.Action, entry.Node, entry.Device, entry.Relay, entry.ClientIp, entry.Outcome, entry.Status)
+	if err != nil {
+		slog.Error("failed to record audit entry", "action", entry.Action, "err", err)
+	}
+}
+
+type AuditFilter struct {
+	UserId  int64
+	Action  string
+	Node    string
+	Device  int
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Before is the id entries are older than, 0 starts with the newest
+	Before int64
+	Limit  int
+}
+
+func parseAuditTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseAuditFilter reads the filter from the query of GET /audit
+func parseAuditFilter(query map[string][]string) (AuditFilter, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	filter := AuditFilter{
+		Action:  get("action"),
+		Node:    get("node"),
+		Outcome: get("outcome"),
+		Limit:   100,
+	}
+
+	var err error
+	if v := get("user_id"); v != "" {
+		if filter.UserId, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, err
+		}
+	}
+	if v := get("device"); v != "" {
+		if filter.Device, err = strconv.Atoi(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := get("since"); v != "" {
+		if filter.Since, err = parseAuditTime(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := get("until"); v != "" {
+		if filter.Until, err = parseAuditTime(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := get("before"); v != "" {
+		if filter.Before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, err
+		}
+	}
+	if v := get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return filter, err
+		}
+	}
+	filter.Limit = max(1, min(filter.Limit, 1000))
+
+	return filter, nil
+}
+
+// queryAudit returns the entries matching the filter, newest first. A limit
+// of 0 returns all of them.
+func queryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+
+	if filter.UserId != 0 {
+		add("user_id = ?", filter.UserId)
+	}
+	if filter.Action != "" {
+		add("action = ?", filter.Action)
+	}
+	if filter.Node != "" {
+		add("node = ?", filter.Node)
+	}
+	if filter.Device != 0 {
+		add("device = ?", filter.Device)
+	}
+	if filter.Outcome != "" {
+		add("outcome = ?", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		add("created_at >= ?", filter.Since.UnixMilli())
+	}
+	if !filter.Until.IsZero() {
+		add("created_at < ?", filter.Until.UnixMilli())
+	}
+	if filter.Before != 0 {
+		add("id < ?", filter.Before)
+	}
+
+	query := "select id, created_at, user_id, action, node, device, relay, client_ip, outcome, status from audit"
+	if len(where) != 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += " order by id desc"
+	if filter.Limit != 0 {
+		query += " limit ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var at int64
+		var userId sql.NullInt64
+		err := rows.Scan(&entry.Id, &at, &userId, &entry.Action, &entry.Node, &entry.Device, &entry.Relay, &entry.ClientIp, &entry.Outcome, &entry.Status)
+		if err != nil {
+			return nil, err
+		}
+		entry.At = time.UnixMilli(at)
+		entry.UserId = userId.Int64
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// exportAudit writes the whole audit log as JSON lines, oldest first
+func exportAudit(w io.Writer) error {
+	entries, err := queryAudit(AuditFilter{})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// fetchBlocklists downloads the configured hosts format blocklists and joins them
+func fetchBlocklists(urls []string) ([]byte, error) {
+	client := http.Client{Timeout: time.Minute}
+
+	hosts := bytes.Buffer{}
+	for _, url := range urls {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("blocklist %s: unexpected status %d", url, resp.StatusCode)
+		}
+
+		_, err = io.Copy(&hosts, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		hosts.WriteByte('\n')
+	}
+
+	return hosts.Bytes(), nil
+}
+
+// pushBlocklist replaces the DNS blocklist of a node, nodes keep the last one they received
+func pushBlocklist(node NodeConfig, hosts []byte) error {
+	req, err := http.NewRequest("POST", "http://"+node.Host+"/dns/blocklist", bytes.NewReader(hosts))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", node.Token)
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// blocklistLoop keeps the blocklists of all nodes up to date, failures are
+// retried after at most five minutes
+func blocklistLoop(config Config, interval time.Duration) {
+	for {
+		failed := false
+
+		hosts, err := fetchBlocklists(config.Blocklists)
+		if err != nil {
+			slog.Error("failed to fetch blocklists", "err", err)
+			failed = true
+		} else {
+			for _, node := range config.Nodes {
+				if err := pushBlocklist(node, hosts); err != nil {
+					slog.Warn("failed to push blocklist", "node", node.Name, "err", err)
+					failed = true
+				} else {
+					slog.Info("pushed blocklist", "node", node.Name, "bytes", len(hosts))
+				}
+			}
+		}
+
+		if failed {
+			time.Sleep(min(interval, 5*time.Minute))
+		} else {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"database/sql"
 	"log"
+	"log/slog"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func initDB() *sql.DB {
-	db, err := sql.Open("sqlite3", "./moleguard.db")
+func initDB(file string) *sql.DB {
+	db, err := sql.Open("sqlite3", file)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -30,5 +32,177 @@ func initDB() *sql.DB {
 		log.Fatal(err)
 	}
 
+	// users get a stable id, the token is a secret and must not end up in logs or metrics
+	addColumn(db, "users", "id integer")
+	for _, stmt := range []string{
+		"create unique index if not exists users_id on users(id)",
+		"update users set id = rowid where id is null",
+		`create trigger if not exists users_id_default after insert on users when new.id is null
+		begin
+			update users set id = new.rowid where rowid = new.rowid;
+		end`,
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// relay operators may change the relay of a node, admins may read the audit log
+	addColumn(db, "users", "relay_operator integer not null default 0")
+	addColumn(db, "users", "admin integer not null default 0")
+
+	// the exit relay of a device, empty when it follows the node's relay
+	addColumn(db, "device", "relay text not null default ''")
+
+	_, err = db.Exec(`create table if not exists port_forward(
+		id integer primary key,
+		node text,
+		public_port integer,
+		protocol text,
+		device_id integer,
+		target_port integer,
+		user_id integer references users(id),
+		unique (node, public_port, protocol)
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`create table if not exists relay_history(
+		id integer primary key,
+		node text,
+		user_id integer references users(id),
+		server text,
+		entry text,
+		reason text,
+		status integer,
+		created_at integer
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`create table if not exists webhook_delivery(
+		id integer primary key,
+		webhook text,
+		event text,
+		payload text,
+		status text,
+		attempts integer,
+		last_status integer not null default 0,
+		last_error text not null default '',
+		created_at integer,
+		next_attempt integer
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the TOTP second factor, totp_last_step keeps codes from being used twice
+	addColumn(db, "users", "totp_secret text not null default ''")
+	addColumn(db, "users", "totp_enabled integer not null default 0")
+	addColumn(db, "users", "totp_last_step integer not null default 0")
+	addColumn(db, "users", "totp_failures integer not null default 0")
+	addColumn(db, "users", "totp_locked_until integer not null default 0")
+
+	for _, stmt := range []string{
+		`create table if not exists recovery_code(
+			id integer primary key,
+			user_id integer references users(id),
+			code_hash text,
+			used_at integer
+		)`,
+		// API tokens stand in for the user token where there is no second factor
+		`create table if not exists api_token(
+			id integer primary key,
+			user_id integer references users(id),
+			token_hash text unique,
+			created_at integer
+		)`,
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// named API tokens, scopes is NULL for full access and expires_at 0 for never
+	addColumn(db, "api_token", "name text not null default ''")
+	addColumn(db, "api_token", "scopes text")
+	addColumn(db, "api_token", "expires_at integer not null default 0")
+	addColumn(db, "api_token", "last_used integer not null default 0")
+
+	// users logging in through OIDC, nodes limits the nodes a user sees when set
+	addColumn(db, "users", "oidc_subject text")
+	addColumn(db, "users", "nodes text")
+	_, err = db.Exec("create unique index if not exists users_oidc_subject on users(oidc_subject)")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// browser sessions, the id is the hash of the cookie's value
+	_, err = db.Exec(`create table if not exists session(
+		id text primary key,
+		user_id integer references users(id),
+		csrf_token text,
+		created_at integer,
+		expires_at integer
+	)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the audit log is append-only, the triggers reject changes to recorded entries
+	for _, stmt := range []string{
+		`create table if not exists audit(
+			id integer primary key,
+			created_at integer,
+			user_id integer references users(id),
+			action text,
+			node text,
+			device integer,
+			relay text,
+			client_ip text,
+			outcome text,
+			status integer
+		)`,
+		"create index if not exists audit_created_at on audit(created_at)",
+		`create trigger if not exists audit_no_update before update on audit
+		begin
+			select raise(abort, 'the audit log is append-only');
+		end`,
+		`create trigger if not exists audit_no_delete before delete on audit
+		begin
+			select raise(abort, 'the audit log is append-only');
+		end`,
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	return db
 }
+
+// addColumn adds a column to an existing table, doing nothing if it is already there
+func addColumn(db *sql.DB, table string, column string) {
+	_, err := db.Exec("alter table " + table + " add column " + column)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		log.Fatal(err)
+	}
+}
+
+// grantRoles sets a role column for the users listed in the config, roles
+// granted earlier are kept
+func grantRoles(role string, userIds []int64) {
+	for _, id := range userIds {
+		result, err := db.Exec("update users set "+role+" = 1 where id = ?", id)
+		check(err)
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			slog.Warn("unknown user in the config", "role", role, "user", id)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// events are also pushed to the users connected to GET /events. Device and
+// quota events only reach the user they belong to, node and relay events
+// reach everyone who sees the node.
+
+type StreamEvent struct {
+	Id    uint64
+	Event string
+	Data  []byte
+}
+
+type subscriber struct {
+	userId int64
+	nodes  nodeList
+	ch     chan StreamEvent
+}
+
+var subscribersMu sync.Mutex
+var subscribers = map[*subscriber]bool{}
+var streamSeq uint64
+
+// eventUser is the user an event is scoped to, 0 for every user
+func eventUser(data any) int64 {
+	switch data := data.(type) {
+	case DeviceEvent:
+		return data.UserId
+	case QuotaEvent:
+		return data.UserId
+	default:
+		return 0
+	}
+}
+
+// eventNode is the node an event is about, empty for none
+func eventNode(data any) string {
+	switch data := data.(type) {
+	case DeviceEvent:
+		return data.Node
+	case RelayEvent:
+		return data.Node
+	case NodeEvent:
+		return data.Node
+	default:
+		return ""
+	}
+}
+
+func subscribe(user *User) *subscriber {
+	sub := &subscriber{userId: user.Id, nodes: user.Nodes, ch: make(chan StreamEvent, 64)}
+
+	subscribersMu.Lock()
+	subscribers[sub] = true
+	subscribersMu.Unlock()
+
+	return sub
+}
+
+func unsubscribe(sub *subscriber) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	if subscribers[sub] {
+		delete(subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// disconnectUser ends the user's streams after their credentials changed,
+// clients that still may see the events reconnect
+func disconnectUser(userId int64) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	for sub := range subscribers {
+		if sub.userId == userId {
+			delete(subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// publish pushes an event to the subscribers allowed to see it. A subscriber
+// that doesn't keep up is disconnected, clients reload their state when they
+// reconnect.
+func publish(event string, data any) {
+	dataJson, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to encode event", "event", event, "err", err)
+		return
+	}
+
+	userId, node := eventUser(data), eventNode(data)
+
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+
+	streamSeq++
+	ev := StreamEvent{Id: streamSeq, Event: event, Data: dataJson}
+
+	for sub := range subscribers {
+		if userId != 0 && sub.userId != userId {
+			continue
+		}
+		if node != "" && sub.nodes != nil && !slices.Contains(sub.nodes, node) {
+			continue
+		}
+
+		select {
+		case sub.ch <- ev:
+		default:
+			slog.Warn("dropping slow event subscriber", "user_id", sub.userId)
+			delete(subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
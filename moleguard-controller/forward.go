@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type PortForward struct {
+	Id         int64  `json:"id"`
+	PublicPort int    `json:"public_port"`
+	Protocol   string `json:"protocol"`
+	DeviceId   int    `json:"device_id"`
+	TargetPort int    `json:"target_port"`
+}
+
+type ForwardById struct {
+	ForwardId int64 `json:"forward_id"`
+}
+
+// NodeForward is a forward as the node sees it, pointing at the device's ip
+type NodeForward struct {
+	PublicPort int    `json:"public_port"`
+	Protocol   string `json:"protocol"`
+	TargetIp   string `json:"target_ip"`
+	TargetPort int    `json:"target_port"`
+}
+
+// nodeError is an error response of a node
+type nodeError struct {
+	Status  int
+	Message string
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("node returned %d: %s", e.Status, e.Message)
+}
+
+func (f PortForward) validate() error {
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol: %s", f.Protocol)
+	}
+	if f.PublicPort < 1 || f.PublicPort > 65535 || f.TargetPort < 1 || f.TargetPort > 65535 {
+		return fmt.Errorf("invalid port")
+	}
+
+	return nil
+}
+
+func nodeForwards(node string) ([]NodeForward, error) {
+	rows, err := db.Query(`select f.public_port, f.protocol, d.ip, f.target_port
+		from port_forward f join device d on d.id = f.device_id and d.node = f.node
+		where f.node = ? order by f.public_port, f.protocol`, node)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	forwards := []NodeForward{}
+	for rows.Next() {
+		var f NodeForward
+		if err := rows.Scan(&f.PublicPort, &f.Protocol, &f.TargetIp, &f.TargetPort); err != nil {
+			return nil, err
+		}
+		f.TargetIp, _, _ = strings.Cut(f.TargetIp, "/")
+
+		forwards = append(forwards, f)
+	}
+
+	return forwards, rows.Err()
+}
+
+// syncForwards pushes the node's complete set of forwards, callers hold deviceMu
+// so the pushes don't overtake each other
+func syncForwards(node NodeConfig) error {
+	forwards, err := nodeForwards(node.Name)
+	if err != nil {
+		return err
+	}
+
+	forwardsJson, err := json.Marshal(&forwards)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+node.Host+"/forwards", bytes.NewReader(forwardsJson))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", node.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBytes, _ := io.ReadAll(resp.Body)
+		return &nodeError{Status: resp.StatusCode, Message: strings.TrimSpace(string(respBytes))}
+	}
+
+	return nil
+}
+
+// forwardsInSync compares the forwards a node has installed with the database
+func forwardsInSync(node NodeConfig) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.Host+"/forwards", nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Authorization", node.Token)
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var installed []NodeForward
+	if err := json.NewDecoder(resp.Body).Decode(&installed); err != nil {
+		return false, err
+	}
+
+	forwards, err := nodeForwards(node.Name)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(installed, forwards), nil
+}
+
+// forwardSyncLoop repairs nodes which missed a change, e.g. because they were down
+func forwardSyncLoop(config Config) {
+	for {
+		for _, node := range config.Nodes {
+			deviceMu.RLock()
+			ok, err := forwardsInSync(node)
+			if err == nil && !ok {
+				slog.Info("port forwards out of sync", "node", node.Name)
+				err = syncForwards(node)
+			}
+			deviceMu.RUnlock()
+
+			if err != nil {
+				slog.Warn("failed to sync port forwards", "node", node.Name, "err", err)
+			}
+		}
+
+		time.Sleep(5 * time.Minute)
+	}
+}
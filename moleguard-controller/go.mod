@@ -2,4 +2,7 @@ module github.com/4831c0/moleguard/moleguard-controller
 
 go 1.25.3
 
-require github.com/mattn/go-sqlite3 v1.14.32
+require (
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+)
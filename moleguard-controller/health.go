@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// a node is unhealthy after this many failed probes in a row
+const unhealthyAfter = 2
+
+// probeNode asks the node whether it is ready, the error holds the reason if not
+func probeNode(node NodeConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.Host+"/readyz", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("not ready: %s", strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// healthLoop probes every node and emits an event when one becomes unhealthy
+// or recovers. Nodes start out healthy, so one that is down at startup is reported.
+func healthLoop(config Config, interval time.Duration) {
+	failures := map[string]int{}
+
+	for {
+		for name, node := range config.Nodes {
+			err := probeNode(node)
+			if err == nil {
+				if failures[name] >= unhealthyAfter {
+					slog.Info("node is healthy again", "node", name)
+					emit(EventNodeHealthy, NodeEvent{Node: name})
+				}
+				failures[name] = 0
+				continue
+			}
+
+			failures[name]++
+			if failures[name] == unhealthyAfter {
+				slog.Warn("node is unhealthy", "node", name, "err", err)
+				emit(EventNodeUnhealthy, NodeEvent{Node: name, Reason: err.Error()})
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
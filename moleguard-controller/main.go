@@ -2,19 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type NodeConfig struct {
+	Name         string `json:"-"`
 	Host         string `json:"host"`
 	TrueEndpoint string `json:"true_endpoint"`
 	Token        string `json:"token"`
@@ -22,10 +28,96 @@ type NodeConfig struct {
 
 type Config struct {
 	Nodes map[string]NodeConfig `json:"nodes"`
+	// LogLevel is one of debug, info, warn or error
+	LogLevel string `json:"log_level"`
+	// Metrics are served on MetricsListen when set, otherwise on the main
+	// listener behind MetricsToken. Without either they are disabled.
+	MetricsListen string `json:"metrics_listen"`
+	MetricsToken  string `json:"metrics_token"`
+	// Blocklists are hosts format urls pushed to the DNS resolver of every
+	// node, they are refreshed every BlocklistRefresh (default 24h)
+	Blocklists       []string `json:"blocklists"`
+	BlocklistRefresh string   `json:"blocklist_refresh"`
+	// MaxPortForwards is the number of port forwards per user (default 5),
+	// public ports are limited to the range the nodes publish
+	MaxPortForwards int `json:"max_port_forwards"`
+	ForwardPortMin  int `json:"forward_port_min"`
+	ForwardPortMax  int `json:"forward_port_max"`
+	// RelayCooldown is the minimum time between relay changes of a node (default 1m)
+	RelayCooldown string `json:"relay_cooldown"`
+	// Webhooks are notified of controller events, nodes are probed for
+	// their health every HealthInterval (default 30s)
+	Webhooks       []WebhookConfig `json:"webhooks"`
+	HealthInterval string          `json:"health_interval"`
+	// SessionTtl is how long a browser session lasts (default 12h)
+	SessionTtl string `json:"session_ttl"`
+	// Oidc enables logins through an OpenID Connect provider
+	Oidc *OidcConfig `json:"oidc"`
+	// RelayOperators and Admins are the ids of users granted these roles at
+	// startup. OIDC users get their roles from their groups on every login.
+	RelayOperators []int64 `json:"relay_operators"`
+	Admins         []int64 `json:"admins"`
+}
+
+type User struct {
+	Id            int64
+	Token         string
+	RelayOperator bool
+	Admin         bool
+	// ApiToken is set when the request was authenticated by an API token
+	ApiToken bool
+	// Scopes limit what the API token may do, nil for full access
+	Scopes []string
+	// Nodes are the nodes the user may see, nil for every node
+	Nodes nodeList
+}
+
+// nodeList is a comma separated list of nodes in the database, NULL is nil
+type nodeList []string
+
+func (l *nodeList) Scan(value any) error {
+	switch value := value.(type) {
+	case nil:
+		*l = nil
+	case string:
+		*l = strings.FieldsFunc(value, func(r rune) bool { return r == ',' })
+		if *l == nil {
+			*l = nodeList{}
+		}
+	case []byte:
+		return l.Scan(string(value))
+	default:
+		return fmt.Errorf("unexpected node list %T", value)
+	}
+	return nil
+}
+
+func (u *User) canSee(node string) bool {
+	return u.Nodes == nil || slices.Contains(u.Nodes, node)
+}
+
+// hasScope tells whether the credential may be used on a route needing the
+// scope, routes without a scope only take credentials with full access
+func (u *User) hasScope(scope string) bool {
+	if u.Scopes == nil || scope == scopeAny {
+		return true
+	}
+	return scope != "" && slices.Contains(u.Scopes, scope)
+}
+
+type userKey struct{}
+
+func currentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey{}).(*User)
+	return user
 }
 
 type LoginReq struct {
 	Token string `json:"token"`
+	// Session starts a browser session, the response holds its CSRF token
+	Session bool `json:"session"`
+	// Otp is a TOTP or recovery code, sessions of users with a second factor need it
+	Otp string `json:"otp"`
 }
 
 type Resp struct {
@@ -64,6 +156,11 @@ type Device struct {
 	Id     int    `json:"id"`
 	Config string `json:"config"`
 	Ip     string `json:"ip"`
+	Relay  string `json:"relay"`
+}
+
+type DeviceRelay struct {
+	Server string `json:"server"`
 }
 
 type DeviceById struct {
@@ -76,30 +173,76 @@ func check(err error) {
 	}
 }
 
-var db = initDB()
+var db *sql.DB
 
-func authMiddleware(next http.Handler) http.Handler {
+func authMiddleware(scope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
 
-		if token == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+		ctx := r.Context()
+		user := &User{Token: token}
+		if token != "" {
+			var totp bool
+			err := db.QueryRow("SELECT id, relay_operator, admin, nodes, totp_enabled FROM users WHERE token = ?", token).Scan(&user.Id, &user.RelayOperator, &user.Admin, &user.Nodes, &totp)
+			if errors.Is(err, sql.ErrNoRows) {
+				user, err = lookupApiToken(token)
+				check(err)
+
+				if user == nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			} else {
+				check(err)
+
+				// with a second factor the user token only starts sessions
+				if totp {
+					auditEntry(r).UserId = user.Id
+					http.Error(w, "the account uses a second factor, use an API token", http.StatusUnauthorized)
+					return
+				}
+			}
+		} else {
+			// browsers send the session cookie instead
+			session, sessionUser, err := lookupSession(r)
+			check(err)
 
-		rows, err := db.Query("SELECT * FROM users WHERE token = ?", token)
-		check(err)
+			if session == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !csrfSafe(r, session) {
+				http.Error(w, "missing or invalid "+csrfHeader, http.StatusForbidden)
+				return
+			}
 
-		if !rows.Next() {
-			w.WriteHeader(http.StatusUnauthorized)
+			user = sessionUser
+			ctx = context.WithValue(ctx, sessionKey{}, session)
+		}
+
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.UserId = user.Id
+		}
+		entry := auditEntry(r)
+		entry.UserId = user.Id
 
-			rows.Close()
+		// nodes the user may not see don't exist for them
+		if node := r.PathValue("node"); node != "" && !user.canSee(node) {
+			entry.Outcome = "denied"
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		rows.Close()
+		if !user.hasScope(scope) {
+			if scope == "" {
+				http.Error(w, "the token needs full access", http.StatusForbidden)
+			} else {
+				http.Error(w, "the token lacks the "+scope+" scope", http.StatusForbidden)
+			}
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, userKey{}, user)))
 	})
 }
 
@@ -137,47 +280,182 @@ func getNextFreeId(node string) (int, error) {
 	return -1, errors.New("could not find a free id")
 }
 
+// setPeerExit routes a device's traffic through the given relay of the node,
+// an empty relay makes it follow the node's relay
+func setPeerExit(node NodeConfig, ip string, relay string) (*http.Response, error) {
+	ip, _, _ = strings.Cut(ip, "/")
+
+	reqBytes, err := json.Marshal(map[string]string{"peer": ip, "relay": relay})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", "http://"+node.Host+"/peer/exit", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", node.Token)
+
+	return nodeDo(node, req)
+}
+
 var deviceMu sync.RWMutex
 
 func main() {
+	exportAuditLog := flag.Bool("export-audit", false, "write the audit log to stdout as JSON lines and exit")
+	flag.Parse()
+
+	db = initDB("./moleguard.db")
+
+	if *exportAuditLog {
+		check(exportAudit(os.Stdout))
+		return
+	}
+
 	var config Config
 	configBytes, err := os.ReadFile("config.json")
 	check(err)
 
+	// mullvadRelays is fetched by the first request that needs it, mullvadRelaysMu guards it
 	var mullvadRelays []MullvadRelay
+	var mullvadRelaysMu sync.Mutex
 
 	check(json.Unmarshal(configBytes, &config))
 
+	for name, node := range config.Nodes {
+		node.Name = name
+		config.Nodes[name] = node
+	}
+
+	var level slog.Level
+	if config.LogLevel != "" {
+		check(level.UnmarshalText([]byte(config.LogLevel)))
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+
+	if len(config.Blocklists) != 0 {
+		refresh := 24 * time.Hour
+		if config.BlocklistRefresh != "" {
+			refresh, err = time.ParseDuration(config.BlocklistRefresh)
+			check(err)
+		}
+
+		go blocklistLoop(config, refresh)
+	}
+
+	if config.MaxPortForwards == 0 {
+		config.MaxPortForwards = 5
+	}
+	if config.ForwardPortMin == 0 && config.ForwardPortMax == 0 {
+		config.ForwardPortMin = 20000
+		config.ForwardPortMax = 20099
+	}
+	go forwardSyncLoop(config)
+
+	relayCooldown := time.Minute
+	if config.RelayCooldown != "" {
+		relayCooldown, err = time.ParseDuration(config.RelayCooldown)
+		check(err)
+	}
+	for name := range config.Nodes {
+		relayLocks[name] = &sync.Mutex{}
+	}
+	grantRoles("relay_operator", config.RelayOperators)
+	grantRoles("admin", config.Admins)
+	go relayLoop(config, relayCooldown)
+
+	check(validateWebhooks(config.Webhooks))
+	webhooks = config.Webhooks
+	check(startWebhooks())
+
+	healthInterval := 30 * time.Second
+	if config.HealthInterval != "" {
+		healthInterval, err = time.ParseDuration(config.HealthInterval)
+		check(err)
+	}
+	go healthLoop(config, healthInterval)
+
+	sessionTtl := 12 * time.Hour
+	if config.SessionTtl != "" {
+		sessionTtl, err = time.ParseDuration(config.SessionTtl)
+		check(err)
+	}
+
+	var oidc *oidcProvider
+	if config.Oidc != nil {
+		oidc = newOidcProvider(*config.Oidc)
+	}
+
 	mux := http.NewServeMux()
 
 	// un-auth
-	mux.Handle("POST /check", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("POST /check", audited("user.login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, err := io.ReadAll(r.Body)
 		check(err)
 
 		var login LoginReq
 		check(json.Unmarshal(bodyBytes, &login))
 
-		rows, err := db.Query("SELECT * FROM users WHERE token = ?", login.Token)
-		check(err)
-
-		defer rows.Close()
+		deny := func(message string, data any) {
+			auditEntry(r).Outcome = "denied"
 
-		if !rows.Next() {
 			respBytes, err := json.Marshal(&Resp{
-				Data:    nil,
+				Data:    data,
 				Success: false,
-				Error:   "Go away",
+				Error:   message,
 			})
 			check(err)
 
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(respBytes)
-			return
+		}
+
+		var userId int64
+		var totp bool
+		err = db.QueryRow("SELECT id, totp_enabled FROM users WHERE token = ?", login.Token).Scan(&userId, &totp)
+		if errors.Is(err, sql.ErrNoRows) {
+			// API tokens let the daemon check its login, they can't start sessions
+			apiUser, err := lookupApiToken(login.Token)
+			check(err)
+
+			if apiUser == nil || login.Session {
+				deny("Go away", nil)
+				return
+			}
+			userId = apiUser.Id
+		} else {
+			check(err)
+		}
+
+		auditEntry(r).UserId = userId
+
+		if totp {
+			if !login.Session {
+				deny("the account uses a second factor, use an API token", nil)
+				return
+			}
+			if login.Otp == "" {
+				deny("second factor required", map[string]bool{"otp_required": true})
+				return
+			}
+
+			err := verifySecondFactor(userId, login.Otp)
+			if errors.Is(err, errInvalidCode) || errors.Is(err, errTotpLocked) {
+				deny(err.Error(), map[string]bool{"otp_required": true})
+				return
+			}
+			check(err)
+		}
+
+		var data any
+		if login.Session {
+			data, err = createSession(w, r, userId, sessionTtl)
+			check(err)
 		}
 
 		respBytes, err := json.Marshal(&Resp{
-			Data:    nil,
+			Data:    data,
 			Success: true,
 			Error:   "",
 		})
@@ -185,223 +463,1214 @@ func main() {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(respBytes)
-	}))
-
-	// auth
-	mux.Handle("GET /nodes", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var keys []string
-		for k := range config.Nodes {
-			keys = append(keys, k)
-		}
+	})))
 
-		kBytes, err := json.Marshal(&keys)
+	mux.Handle("GET /oidc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusJson, err := json.Marshal(map[string]bool{"enabled": oidc != nil})
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(kBytes)
-	})))
-	mux.Handle("GET /relays", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if len(mullvadRelays) == 0 {
-			resp, err := http.Get("https://api.mullvad.net/www/relays/all/")
-			check(err)
-
-			defer resp.Body.Close()
-
-			respBytes, err := io.ReadAll(resp.Body)
-			check(err)
-
-			var relays []MullvadRelay
-
-			check(json.Unmarshal(respBytes, &relays))
-			mullvadRelays = relays
+		w.Write(statusJson)
+	}))
+	mux.Handle("GET /oidc/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
 
-		var hosts []string
-		for _, relay := range mullvadRelays {
-			hosts = append(hosts, relay.Hostname)
+		authUrl, err := oidc.authUrl()
+		if err != nil {
+			slog.Error("oidc discovery failed", "err", err)
+			http.Error(w, "the identity provider is unavailable", http.StatusBadGateway)
+			return
 		}
 
-		hostsBytes, err := json.Marshal(&hosts)
-		check(err)
+		http.Redirect(w, r, authUrl, http.StatusFound)
+	}))
+	mux.Handle("GET /oidc/callback", audited("user.oidc_login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(hostsBytes)
-	})))
-	mux.Handle("GET /{node}/pk", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		node, ok := config.Nodes[r.PathValue("node")]
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+			return
+		}
 
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
+		claims, err := oidc.exchange(query.Get("state"), query.Get("code"))
+		if err != nil {
+			slog.Warn("oidc login failed", "err", err)
+			http.Error(w, "login failed", http.StatusUnauthorized)
 			return
 		}
 
-		r, err := http.NewRequest("GET", "http://"+node.Host+"/pk", nil)
+		userId, err := oidc.provision(claims, config.Nodes)
 		check(err)
 
-		r.Header.Set("Authorization", node.Token)
+		auditEntry(r).UserId = userId
 
-		resp, err := http.DefaultClient.Do(r)
+		totp, err := totpEnabled(userId)
 		check(err)
 
-		defer resp.Body.Close()
-		respBytes, err := io.ReadAll(resp.Body)
+		// a redirect would still count as coming from the provider and
+		// browsers would hold back the SameSite cookie on the next page
+		w.Header().Set("Content-Type", "text/html")
+
+		if totp {
+			oidc.holdForSecondFactor(w, r, userId)
+			w.Write([]byte(`<!DOCTYPE html><meta http-equiv="refresh" content="0; url=/#otp">`))
+			return
+		}
+
+		_, err = createSession(w, r, userId, sessionTtl)
 		check(err)
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write(respBytes)
+		w.Write([]byte(`<!DOCTYPE html><meta http-equiv="refresh" content="0; url=/main/">`))
 	})))
-	_, err = os.Stat("chisel.json")
-	if err == nil {
-		mux.Handle("GET /chisel.json", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			respBytes, err := os.ReadFile("chisel.json")
-			check(err)
+	mux.Handle("POST /oidc/otp", audited("user.oidc_login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidc == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(respBytes)
-		})))
-	}
-	mux.Handle("GET /{node}/device", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		deviceMu.RLock()
-		defer deviceMu.RUnlock()
+		userId, ok := oidc.pendingUser(r)
+		if !ok {
+			http.Error(w, "no login waiting for a second factor", http.StatusUnauthorized)
+			return
+		}
 
-		rows, err := db.Query("select id, user_token, config, ip from device where node = ? and user_token = ?",
-			r.PathValue("node"),
-			r.Header.Get("Authorization"),
-		)
-		check(err)
+		auditEntry(r).UserId = userId
 
-		defer rows.Close()
+		bodyBytes, err := io.ReadAll(r.Body)
+		check(err)
 
-		devices := make([]Device, 0)
+		var code TotpCode
+		if err := json.Unmarshal(bodyBytes, &code); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		for rows.Next() {
-			var device Device
-			var ignored string
-			check(rows.Scan(&device.Id, &ignored, &device.Config, &device.Ip))
-			_ = ignored
+		resp := Resp{Success: true}
+		err = verifySecondFactor(userId, code.Code)
+		if errors.Is(err, errInvalidCode) || errors.Is(err, errTotpLocked) {
+			auditEntry(r).Outcome = "denied"
+			resp = Resp{Error: err.Error(), Data: map[string]bool{"otp_required": true}}
+		} else {
+			check(err)
 
-			devices = append(devices, device)
+			oidc.releaseSecondFactor(w, r)
+			_, err = createSession(w, r, userId, sessionTtl)
+			check(err)
 		}
 
-		devicesJson, err := json.Marshal(&devices)
+		respBytes, err := json.Marshal(&resp)
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(devicesJson)
+		w.Write(respBytes)
 	})))
-	mux.Handle("POST /{node}/device", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		deviceMu.Lock()
-		defer deviceMu.Unlock()
-
-		node, ok := config.Nodes[r.PathValue("node")]
 
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
+	// auth
+	mux.Handle("POST /api-token", audited("user.api_token", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't create API tokens", http.StatusForbidden)
 			return
 		}
 
-		id, err := getNextFreeId(r.PathValue("node"))
+		// the daemon only reads, a token with daemonScopes is enough
+		token, err := createApiToken(user.Id, "daemon", daemonScopes, time.Time{})
 		check(err)
 
-		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/config?id=%d", node.Host, id), nil)
+		tokenJson, err := json.Marshal(map[string]string{"api_token": token.Token})
 		check(err)
 
-		req.Header.Set("Authorization", node.Token)
-
-		resp, err := http.DefaultClient.Do(req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(tokenJson)
+	}))))
+	mux.Handle("GET /tokens", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens, err := listApiTokens(currentUser(r).Id)
 		check(err)
 
-		defer resp.Body.Close()
-		respBytes, err := io.ReadAll(resp.Body)
+		tokensJson, err := json.Marshal(tokens)
 		check(err)
 
-		conf := strings.ReplaceAll(string(respBytes), "Endpoint = 127.0.0.1:51820", "Endpoint = "+node.TrueEndpoint)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(tokensJson)
+	})))
+	mux.Handle("POST /tokens", audited("user.token_create", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't create API tokens", http.StatusForbidden)
+			return
+		}
 
-		userToken := r.Header.Get("Authorization")
+		bodyBytes, err := io.ReadAll(r.Body)
+		check(err)
 
-		confLines := strings.Split(conf, "\n")
-		ip := "N/A"
-		for _, line := range confLines {
-			if strings.HasPrefix(line, "Address = ") {
-				ip = strings.TrimPrefix(line, "Address = ")
-				break
-			}
+		var tokenReq ApiTokenReq
+		if err := json.Unmarshal(bodyBytes, &tokenReq); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		expiresAt, err := tokenReq.validate()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		_, err = db.Exec("insert into device values(?, ?, ?, ?, ?)", id, r.PathValue("node"), userToken, conf, ip)
+		token, err := createApiToken(user.Id, tokenReq.Name, tokenReq.Scopes, expiresAt)
 		check(err)
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(fmt.Sprintf("%d", id)))
-	})))
-	mux.Handle("DELETE /{node}/device", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		deviceMu.Lock()
-		defer deviceMu.Unlock()
+		tokenJson, err := json.Marshal(token)
+		check(err)
 
-		reqBytes, err := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(tokenJson)
+	}))))
+	mux.Handle("DELETE /tokens", audited("user.token_revoke", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := io.ReadAll(r.Body)
 		check(err)
 
-		var deviceId DeviceById
-		check(json.Unmarshal(reqBytes, &deviceId))
+		var byId TokenById
+		if err := json.Unmarshal(bodyBytes, &byId); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		_, err = db.Exec("delete from device where id = ? and node = ?", deviceId.DeviceId, r.PathValue("node"))
+		ok, err := revokeApiToken(currentUser(r).Id, byId.TokenId)
 		check(err)
 
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("OK"))
-	})))
-	mux.Handle("GET /{node}/relay", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		node, ok := config.Nodes[r.PathValue("node")]
-
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		r, err := http.NewRequest("GET", "http://"+node.Host+"/relay", nil)
-		check(err)
 
-		r.Header.Set("Authorization", node.Token)
+		disconnectUser(currentUser(r).Id)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("POST /token/rotate", audited("user.token_rotate", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't rotate the user token", http.StatusForbidden)
+			return
+		}
+
+		keepSession := ""
+		if cookie, err := r.Cookie(sessionCookie); err == nil && currentSession(r) != nil {
+			keepSession = hashToken(cookie.Value)
+		}
 
-		resp, err := http.DefaultClient.Do(r)
+		token, err := rotateUserToken(user.Id, keepSession)
 		check(err)
 
-		defer resp.Body.Close()
-		respBytes, err := io.ReadAll(resp.Body)
+		disconnectUser(user.Id)
+
+		tokenJson, err := json.Marshal(map[string]string{"token": token})
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(respBytes)
-	})))
-	mux.Handle("POST /{node}/relay", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		node, ok := config.Nodes[r.PathValue("node")]
+		w.Write(tokenJson)
+	}))))
+	// the daemon revokes its token on logout, whatever kind of token it is
+	mux.Handle("POST /token/revoke", audited("user.token_revoke", authMiddleware(scopeAny, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+
+		var revocation TokenRevocation
+		switch {
+		case currentSession(r) != nil:
+			check(endSession(w, r))
+			revocation.Revoked = "session"
+		case user.ApiToken:
+			ok, err := revokeApiTokenByValue(r.Header.Get("Authorization"))
+			check(err)
 
-		if !ok {
-			w.WriteHeader(http.StatusNotFound)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			revocation.Revoked = "api_token"
+		default:
+			// nothing else would start a session once the user token is gone
+			http.Error(w, "the user token can't be revoked, rotate it in the web panel or with POST /token/rotate", http.StatusConflict)
 			return
 		}
-		reqBody, err := io.ReadAll(r.Body)
-		check(err)
 
-		r, err = http.NewRequest("POST", "http://"+node.Host+"/relay", nil)
+		disconnectUser(user.Id)
+
+		revocationJson, err := json.Marshal(revocation)
 		check(err)
 
-		r.Header.Set("Authorization", node.Token)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(revocationJson)
+	}))))
+	mux.Handle("GET /session", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := currentSession(r)
+		if session == nil {
+			http.Error(w, "not a session", http.StatusNotFound)
+			return
+		}
+
+		sessionJson, err := json.Marshal(session)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(sessionJson)
+	})))
+	mux.Handle("POST /logout", audited("user.logout", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check(endSession(w, r))
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("GET /totp", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled, err := totpEnabled(currentUser(r).Id)
+		check(err)
+
+		statusJson, err := json.Marshal(map[string]bool{"enabled": enabled})
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(statusJson)
+	})))
+	mux.Handle("POST /totp/enroll", audited("user.totp_enroll", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't manage the second factor", http.StatusForbidden)
+			return
+		}
+
+		enabled, err := totpEnabled(user.Id)
+		check(err)
+		if enabled {
+			http.Error(w, "the second factor is already enabled", http.StatusConflict)
+			return
+		}
+
+		enrollment, err := enrollTotp(user.Id)
+		check(err)
+
+		enrollmentJson, err := json.Marshal(enrollment)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(enrollmentJson)
+	}))))
+	mux.Handle("POST /totp/confirm", audited("user.totp_confirm", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't manage the second factor", http.StatusForbidden)
+			return
+		}
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		var code TotpCode
+		err = json.Unmarshal(reqBytes, &code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		confirmation, err := confirmTotp(user.Id, code.Code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		confirmationJson, err := json.Marshal(confirmation)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(confirmationJson)
+	}))))
+	mux.Handle("POST /totp/disable", audited("user.totp_disable", authMiddleware("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := currentUser(r)
+		if user.ApiToken {
+			http.Error(w, "API tokens can't manage the second factor", http.StatusForbidden)
+			return
+		}
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		var code TotpCode
+		err = json.Unmarshal(reqBytes, &code)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = verifySecondFactor(user.Id, code.Code)
+		if errors.Is(err, errInvalidCode) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errTotpLocked) {
+			auditEntry(r).Outcome = "denied"
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		check(err)
+
+		check(disableTotp(user.Id))
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("GET /nodes", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		for k := range config.Nodes {
+			if currentUser(r).canSee(k) {
+				keys = append(keys, k)
+			}
+		}
+
+		kBytes, err := json.Marshal(&keys)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(kBytes)
+	})))
+	mux.Handle("GET /relays", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mullvadRelaysMu.Lock()
+		relays := mullvadRelays
+		mullvadRelaysMu.Unlock()
+
+		if len(relays) == 0 {
+			resp, err := http.Get("https://api.mullvad.net/www/relays/all/")
+			check(err)
+
+			defer resp.Body.Close()
+
+			respBytes, err := io.ReadAll(resp.Body)
+			check(err)
+
+			check(json.Unmarshal(respBytes, &relays))
+
+			mullvadRelaysMu.Lock()
+			mullvadRelays = relays
+			mullvadRelaysMu.Unlock()
+
+			metricsMu.Lock()
+			relaysFetchedAt = time.Now()
+			metricsMu.Unlock()
+		}
+
+		var hosts []string
+		for _, relay := range relays {
+			hosts = append(hosts, relay.Hostname)
+		}
+
+		hostsBytes, err := json.Marshal(&hosts)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(hostsBytes)
+	})))
+	mux.Handle("GET /{node}/pk", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/pk", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(respBytes)
+	})))
+	_, err = os.Stat("chisel.json")
+	if err == nil {
+		mux.Handle("GET /chisel.json", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			respBytes, err := os.ReadFile("chisel.json")
+			check(err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(respBytes)
+		})))
+	}
+	mux.Handle("GET /{node}/device", authMiddleware(scopeDevicesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.RLock()
+		defer deviceMu.RUnlock()
+
+		rows, err := db.Query("select id, user_token, config, ip, relay from device where node = ? and user_token = ?",
+			r.PathValue("node"),
+			currentUser(r).Token,
+		)
+		check(err)
+
+		defer rows.Close()
+
+		devices := make([]Device, 0)
+
+		for rows.Next() {
+			var device Device
+			var ignored string
+			check(rows.Scan(&device.Id, &ignored, &device.Config, &device.Ip, &device.Relay))
+			_ = ignored
+
+			devices = append(devices, device)
+		}
+
+		devicesJson, err := json.Marshal(&devices)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(devicesJson)
+	})))
+	mux.Handle("POST /{node}/device", audited("device.create", authMiddleware(scopeDevicesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.Lock()
+		defer deviceMu.Unlock()
+
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		id, err := getNextFreeId(r.PathValue("node"))
+		check(err)
+
+		auditEntry(r).Device = id
+
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/config?id=%d", node.Host, id), nil)
+		check(err)
+
+		req.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		conf := strings.ReplaceAll(string(respBytes), "Endpoint = 127.0.0.1:51820", "Endpoint = "+node.TrueEndpoint)
+
+		userToken := currentUser(r).Token
+
+		confLines := strings.Split(conf, "\n")
+		ip := "N/A"
+		for _, line := range confLines {
+			if strings.HasPrefix(line, "Address = ") {
+				ip = strings.TrimPrefix(line, "Address = ")
+				break
+			}
+		}
+
+		_, err = db.Exec("insert into device(id, node, user_token, config, ip) values(?, ?, ?, ?, ?)", id, r.PathValue("node"), userToken, conf, ip)
+		check(err)
+
+		emit(EventDeviceCreated, DeviceEvent{Node: node.Name, UserId: currentUser(r).Id, Device: id, Ip: ip})
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(fmt.Sprintf("%d", id)))
+	}))))
+	mux.Handle("DELETE /{node}/device", audited("device.delete", authMiddleware(scopeDevicesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.Lock()
+		defer deviceMu.Unlock()
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		var deviceId DeviceById
+		check(json.Unmarshal(reqBytes, &deviceId))
+
+		auditEntry(r).Device = deviceId.DeviceId
+
+		user := currentUser(r)
+
+		// other users' devices don't exist for the user
+		var ip, relay string
+		err = db.QueryRow("select ip, relay from device where id = ? and node = ? and user_token = ?", deviceId.DeviceId, r.PathValue("node"), user.Token).Scan(&ip, &relay)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "no such device", http.StatusNotFound)
+			return
+		}
+		check(err)
+
+		res, err := db.Exec("delete from device where id = ? and node = ? and user_token = ?", deviceId.DeviceId, r.PathValue("node"), user.Token)
+		check(err)
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "no such device", http.StatusNotFound)
+			return
+		}
+		emit(EventDeviceDeleted, DeviceEvent{Node: r.PathValue("node"), UserId: user.Id, Device: deviceId.DeviceId, Ip: ip})
+
+		// the next device with this address follows the node's relay
+		if node, ok := config.Nodes[r.PathValue("node")]; ok && relay != "" {
+			resp, err := setPeerExit(node, ip, "")
+			if err != nil {
+				slog.Warn("failed to reset device relay", "node", node.Name, "err", err)
+			} else {
+				resp.Body.Close()
+			}
+		}
+
+		// the device's forwards go with it
+		res, err = db.Exec("delete from port_forward where device_id = ? and node = ?", deviceId.DeviceId, r.PathValue("node"))
+		check(err)
+
+		if n, _ := res.RowsAffected(); n != 0 {
+			if node, ok := config.Nodes[r.PathValue("node")]; ok {
+				if err := syncForwards(node); err != nil {
+					slog.Warn("failed to sync port forwards", "node", node.Name, "err", err)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("POST /{node}/device/{id}/relay", audited("device.relay", authMiddleware(scopeDevicesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.Lock()
+		defer deviceMu.Unlock()
+
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		var relay DeviceRelay
+		err = json.Unmarshal(reqBytes, &relay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entry := auditEntry(r)
+		entry.Device, _ = strconv.Atoi(r.PathValue("id"))
+		entry.Relay = relay.Server
+
+		var ip string
+		err = db.QueryRow("select ip from device where id = ? and node = ? and user_token = ?", r.PathValue("id"), node.Name, currentUser(r).Token).Scan(&ip)
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		check(err)
+
+		resp, err := setPeerExit(node, ip, relay.Server)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		if resp.StatusCode == http.StatusOK {
+			_, err = db.Exec("update device set relay = ? where id = ? and node = ?", relay.Server, r.PathValue("id"), node.Name)
+			check(err)
+		}
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	}))))
+	mux.Handle("GET /{node}/forward", authMiddleware(scopeDevicesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.RLock()
+		defer deviceMu.RUnlock()
+
+		rows, err := db.Query("select id, public_port, protocol, device_id, target_port from port_forward where node = ? and user_id = ? order by public_port, protocol", r.PathValue("node"), currentUser(r).Id)
+		check(err)
+
+		defer rows.Close()
+
+		forwards := []PortForward{}
+		for rows.Next() {
+			var f PortForward
+			check(rows.Scan(&f.Id, &f.PublicPort, &f.Protocol, &f.DeviceId, &f.TargetPort))
+
+			forwards = append(forwards, f)
+		}
+
+		forwardsJson, err := json.Marshal(&forwards)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(forwardsJson)
+	})))
+	mux.Handle("POST /{node}/forward", audited("forward.create", authMiddleware(scopeDevicesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.Lock()
+		defer deviceMu.Unlock()
+
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		forward := PortForward{Protocol: "tcp"}
+		err = json.Unmarshal(reqBytes, &forward)
+		if err == nil {
+			err = forward.validate()
+		}
+		if err == nil && (forward.PublicPort < config.ForwardPortMin || forward.PublicPort > config.ForwardPortMax) {
+			err = fmt.Errorf("public port must be between %d and %d", config.ForwardPortMin, config.ForwardPortMax)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		auditEntry(r).Device = forward.DeviceId
+
+		user := currentUser(r)
+
+		var owned int
+		check(db.QueryRow("select count(*) from device where id = ? and node = ? and user_token = ?", forward.DeviceId, node.Name, user.Token).Scan(&owned))
+		if owned == 0 {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+
+		var count int
+		check(db.QueryRow("select count(*) from port_forward where user_id = ?", user.Id).Scan(&count))
+		if count >= config.MaxPortForwards {
+			emit(EventQuotaExceeded, QuotaEvent{UserId: user.Id, Quota: "port_forwards", Limit: config.MaxPortForwards})
+			http.Error(w, fmt.Sprintf("limit of %d port forwards reached", config.MaxPortForwards), http.StatusForbidden)
+			return
+		}
+
+		var taken int
+		check(db.QueryRow("select count(*) from port_forward where node = ? and public_port = ? and protocol = ?", node.Name, forward.PublicPort, forward.Protocol).Scan(&taken))
+		if taken != 0 {
+			http.Error(w, "port is already forwarded", http.StatusConflict)
+			return
+		}
+
+		res, err := db.Exec("insert into port_forward(node, public_port, protocol, device_id, target_port, user_id) values(?, ?, ?, ?, ?, ?)",
+			node.Name, forward.PublicPort, forward.Protocol, forward.DeviceId, forward.TargetPort, user.Id)
+		check(err)
+
+		forward.Id, err = res.LastInsertId()
+		check(err)
+
+		if err := syncForwards(node); err != nil {
+			_, dbErr := db.Exec("delete from port_forward where id = ?", forward.Id)
+			check(dbErr)
+
+			var nodeErr *nodeError
+			if errors.As(err, &nodeErr) && nodeErr.Status == http.StatusBadRequest {
+				http.Error(w, nodeErr.Message, http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		forwardJson, err := json.Marshal(&forward)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(forwardJson)
+	}))))
+	mux.Handle("DELETE /{node}/forward", audited("forward.delete", authMiddleware(scopeDevicesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deviceMu.Lock()
+		defer deviceMu.Unlock()
+
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		reqBytes, err := io.ReadAll(r.Body)
+		check(err)
+
+		var forwardId ForwardById
+		check(json.Unmarshal(reqBytes, &forwardId))
+
+		res, err := db.Exec("delete from port_forward where id = ? and node = ? and user_id = ?", forwardId.ForwardId, node.Name, currentUser(r).Id)
+		check(err)
+
+		if n, _ := res.RowsAffected(); n == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// the forward is gone from the database, a node that missed it is repaired by the sync loop
+		if err := syncForwards(node); err != nil {
+			slog.Warn("failed to sync port forwards", "node", node.Name, "err", err)
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("GET /{node}/relay", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/relay", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBytes)
+	})))
+	mux.Handle("GET /{node}/relay/ranking", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/relay/ranking?"+r.URL.RawQuery, nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})))
+	mux.Handle("POST /{node}/relay", audited("relay.change", authMiddleware(scopeRelayWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		user := currentUser(r)
+		entry := auditEntry(r)
+		if !user.RelayOperator {
+			http.Error(w, "changing the relay requires the relay operator permission", http.StatusForbidden)
+			return
+		}
+
+		// changes are not queued, the node would run them one after the other
+		lock := relayLocks[node.Name]
+		if !lock.TryLock() {
+			http.Error(w, "a relay change is already in progress on this node", http.StatusConflict)
+			return
+		}
+		defer lock.Unlock()
+
+		if wait := relayCooldownLeft(node.Name, relayCooldown); wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+			http.Error(w, fmt.Sprintf("the relay of this node was changed recently, try again in %s", wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+
+		reqBody, err := io.ReadAll(r.Body)
+		check(err)
+
+		var change RelayChange
+		err = json.Unmarshal(reqBody, &change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		entry.Relay = change.Server
+
+		emit(EventRelayChanging, RelayEvent{Node: node.Name, UserId: user.Id, Server: change.Server, Entry: change.Entry, Reason: change.Reason})
+
+		r, err = http.NewRequest("POST", "http://"+node.Host+"/relay", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
 		r.Body = io.NopCloser(bytes.NewReader(reqBody))
 
-		resp, err := http.DefaultClient.Do(r)
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			recordRelayChange(node.Name, user.Id, change, http.StatusBadGateway)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		recordRelayChange(node.Name, user.Id, change, resp.StatusCode)
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	}))))
+	mux.Handle("GET /{node}/relay/history", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := config.Nodes[r.PathValue("node")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		history, err := relayHistory(r.PathValue("node"), 100)
+		check(err)
+
+		historyJson, err := json.Marshal(&history)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(historyJson)
+	})))
+	mux.Handle("GET /audit", authMiddleware(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		filter, err := parseAuditFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page := AuditPage{}
+		page.Entries, err = queryAudit(filter)
+		check(err)
+
+		if len(page.Entries) == filter.Limit {
+			page.Next = page.Entries[len(page.Entries)-1].Id
+		}
+
+		pageJson, err := json.Marshal(&page)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(pageJson)
+	})))
+	mux.Handle("GET /webhooks/deliveries", authMiddleware(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		clause := "where (? = '' or status = ?) and (? = '' or webhook = ?) order by id desc limit 100"
+		status, webhook := r.URL.Query().Get("status"), r.URL.Query().Get("webhook")
+
+		deliveries, err := queryDeliveries(clause, status, status, webhook, webhook)
+		check(err)
+
+		deliveriesJson, err := json.Marshal(&deliveries)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(deliveriesJson)
+	})))
+	mux.Handle("POST /webhooks/deliveries/{id}/replay", audited("webhook.replay", authMiddleware(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ok, err := replayDelivery(id)
+		if errors.Is(err, errWebhookNotConfigured) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		check(err)
+
+		if !ok {
+			http.Error(w, "no such delivery or it is still pending", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("OK"))
+	}))))
+	mux.Handle("GET /events", authMiddleware(scopeDevicesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		sub := subscribe(currentUser(r))
+		defer unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		flusher.Flush()
+
+		// comments keep proxies from closing an idle stream
+		ping := time.NewTicker(25 * time.Second)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev, ok := <-sub.ch:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Id, ev.Event, ev.Data)
+			case <-ping.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			flusher.Flush()
+		}
+	})))
+	mux.Handle("GET /{node}/rotation", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/rotation", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})))
+	mux.Handle("POST /{node}/rotation", audited("node.rotation", authMiddleware(scopeNodesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !currentUser(r).RelayOperator {
+			http.Error(w, "changing the rotation policy requires the relay operator permission", http.StatusForbidden)
+			return
+		}
+		reqBody, err := io.ReadAll(r.Body)
+		check(err)
+
+		r, err = http.NewRequest("POST", "http://"+node.Host+"/rotation", bytes.NewReader(reqBody))
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	}))))
+	mux.Handle("GET /{node}/settings", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/settings", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})))
+	mux.Handle("POST /{node}/settings", audited("node.settings", authMiddleware(scopeNodesWrite, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if !currentUser(r).RelayOperator {
+			http.Error(w, "changing the settings requires the relay operator permission", http.StatusForbidden)
+			return
+		}
+		reqBody, err := io.ReadAll(r.Body)
+		check(err)
+
+		r, err = http.NewRequest("POST", "http://"+node.Host+"/settings", bytes.NewReader(reqBody))
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	}))))
+	mux.Handle("GET /{node}/status", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/status", nil)
+		check(err)
+
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		defer resp.Body.Close()
+		respBytes, err := io.ReadAll(resp.Body)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(respBytes)
+	})))
+	mux.Handle("GET /{node}/dns", authMiddleware(scopeNodesRead, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node, ok := config.Nodes[r.PathValue("node")]
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r, err := http.NewRequest("GET", "http://"+node.Host+"/dns", nil)
 		check(err)
 
+		r.Header.Set("Authorization", node.Token)
+
+		resp, err := nodeDo(node, r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
 		defer resp.Body.Close()
 		respBytes, err := io.ReadAll(resp.Body)
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
 		w.Write(respBytes)
 	})))
 
-	mux.Handle("/private/static/", authMiddleware(http.StripPrefix("/private/static", http.FileServer(http.Dir("./private")))))
+	mux.Handle("/private/static/", authMiddleware("", http.StripPrefix("/private/static", http.FileServer(http.Dir("./private")))))
 	mux.Handle("/", http.FileServer(http.Dir("./static")))
 
-	log.Println("Listening on http://127.0.0.1:6128")
-	log.Fatal(http.ListenAndServe(":6128", mux))
+	metricsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.MetricsToken != "" && strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") != config.MetricsToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	if config.MetricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metricsHandler)
+
+		go func() {
+			slog.Info("metrics listening", "addr", config.MetricsListen)
+			check(http.ListenAndServe(config.MetricsListen, metricsMux))
+		}()
+	} else if config.MetricsToken != "" {
+		mux.Handle("GET /metrics", metricsHandler)
+	}
+
+	slog.Info("listening", "addr", "http://127.0.0.1:6128")
+	check(http.ListenAndServe(":6128", instrument(mux)))
 }
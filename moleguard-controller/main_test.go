@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useTestDB gives the test an empty database of its own
+func useTestDB(t *testing.T) {
+	saved := db
+	db = initDB(filepath.Join(t.TempDir(), "moleguard.db"))
+
+	t.Cleanup(func() {
+		db.Close()
+		db = saved
+	})
+}
+
+func addTestUser(t *testing.T, token string) int64 {
+	res, err := db.Exec("insert into users(token) values(?)", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		scope  string
+		ok     bool
+	}{
+		{"full access on a full access route", nil, "", true},
+		{"full access on a scoped route", nil, scopeNodesWrite, true},
+		{"scoped on a full access route", []string{scopeNodesRead}, "", false},
+		{"scoped on its scope", []string{scopeNodesRead}, scopeNodesRead, true},
+		{"scoped on another scope", []string{scopeNodesRead}, scopeNodesWrite, false},
+		{"scoped on any scope", []string{scopeNodesRead}, scopeAny, true},
+		{"several scopes", []string{scopeNodesRead, scopeRelayWrite}, scopeRelayWrite, true},
+		{"no scopes", []string{}, scopeNodesRead, false},
+		{"no scopes on any scope", []string{}, scopeAny, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{Scopes: tt.scopes}
+			if ok := user.hasScope(tt.scope); ok != tt.ok {
+				t.Fatalf("hasScope(%q) = %v, want %v", tt.scope, ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	useTestDB(t)
+
+	addTestUser(t, "user-token")
+
+	totpUser := addTestUser(t, "totp-token")
+	_, err := db.Exec("update users set totp_enabled = 1 where id = ?", totpUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limitedUser := addTestUser(t, "limited-token")
+	_, err = db.Exec("update users set nodes = 'n1' where id = ?", limitedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiToken := func(scopes []string, expiresAt time.Time) string {
+		token, err := createApiToken(totpUser, "test", scopes, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+	fullToken := apiToken(nil, time.Time{})
+	readToken := apiToken([]string{scopeNodesRead}, time.Time{})
+	writeToken := apiToken([]string{scopeNodesWrite}, time.Time{})
+	expiredToken := apiToken([]string{scopeNodesRead}, time.Now().Add(-time.Minute))
+
+	recorder := httptest.NewRecorder()
+	session, err := createSession(recorder, httptest.NewRequest("POST", "/check", nil), totpUser, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionCookie := recorder.Result().Cookies()[0]
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("GET /{node}/relay", authMiddleware(scopeNodesRead, ok))
+	mux.Handle("POST /{node}/rotation", authMiddleware(scopeNodesWrite, ok))
+	mux.Handle("POST /tokens", authMiddleware("", ok))
+	mux.Handle("POST /token/revoke", authMiddleware(scopeAny, ok))
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		session bool
+		csrf    string
+		status  int
+	}{
+		{"no credentials", "GET", "/n1/relay", "", false, "", http.StatusUnauthorized},
+		{"unknown token", "GET", "/n1/relay", "unknown", false, "", http.StatusUnauthorized},
+		{"user token", "POST", "/n1/rotation", "user-token", false, "", http.StatusOK},
+		{"user token on a full access route", "POST", "/tokens", "user-token", false, "", http.StatusOK},
+		{"user token with a second factor", "GET", "/n1/relay", "totp-token", false, "", http.StatusUnauthorized},
+		{"full access token", "POST", "/tokens", fullToken, false, "", http.StatusOK},
+		{"read token reads", "GET", "/n1/relay", readToken, false, "", http.StatusOK},
+		{"read token writes", "POST", "/n1/rotation", readToken, false, "", http.StatusForbidden},
+		{"read token on a full access route", "POST", "/tokens", readToken, false, "", http.StatusForbidden},
+		{"read token revokes itself", "POST", "/token/revoke", readToken, false, "", http.StatusOK},
+		{"write token writes", "POST", "/n1/rotation", writeToken, false, "", http.StatusOK},
+		{"write token reads", "GET", "/n1/relay", writeToken, false, "", http.StatusForbidden},
+		{"expired token", "GET", "/n1/relay", expiredToken, false, "", http.StatusUnauthorized},
+		{"allowed node", "GET", "/n1/relay", "limited-token", false, "", http.StatusOK},
+		{"hidden node", "GET", "/n2/relay", "limited-token", false, "", http.StatusNotFound},
+		{"session reads", "GET", "/n1/relay", "", true, "", http.StatusOK},
+		{"session writes without csrf token", "POST", "/n1/rotation", "", true, "", http.StatusForbidden},
+		{"session writes with another csrf token", "POST", "/n1/rotation", "", true, "other", http.StatusForbidden},
+		{"session writes with its csrf token", "POST", "/n1/rotation", "", true, session.CsrfToken, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", tt.token)
+			}
+			if tt.session {
+				r.AddCookie(sessionCookie)
+			}
+			if tt.csrf != "" {
+				r.Header.Set(csrfHeader, tt.csrf)
+			}
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics are exposed in the prometheus text format
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+type routeKey struct {
+	Route string
+	Code  int
+}
+
+var metricsMu sync.Mutex
+var requestCounts = map[routeKey]uint64{}
+var requestDurations = map[string]*histogram{}
+var nodeProxyErrors = map[string]uint64{}
+
+// relaysFetchedAt is when the mullvad relay catalogue was last fetched
+var relaysFetchedAt time.Time
+
+func observeRequest(route string, code int, d time.Duration) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	requestCounts[routeKey{Route: route, Code: code}]++
+	if requestDurations[route] == nil {
+		requestDurations[route] = newHistogram(0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 30)
+	}
+	requestDurations[route].observe(d.Seconds())
+}
+
+// nodeDo sends a request to a node, failures are logged and counted per node
+func nodeDo(node NodeConfig, req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("node request failed", "node", node.Name, "path", req.URL.Path, "err", err)
+
+		metricsMu.Lock()
+		nodeProxyErrors[node.Name]++
+		metricsMu.Unlock()
+	}
+
+	return resp, err
+}
+
+type requestInfo struct {
+	UserId int64
+}
+
+type requestInfoKey struct{}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument logs every request and records it in the per route metrics.
+// authMiddleware fills in the user id through the requestInfo in the context.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+
+		defer func() {
+			// handlers panic on unexpected errors, net/http recovers after the request is recorded
+			v := recover()
+			if v != nil {
+				sw.status = http.StatusInternalServerError
+			}
+
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched"
+			}
+			elapsed := time.Since(start)
+			observeRequest(route, sw.status, elapsed)
+
+			attrs := []any{
+				"method", r.Method,
+				"route", route,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"duration_ms", elapsed.Milliseconds(),
+				"remote", r.RemoteAddr,
+			}
+			if info.UserId != 0 {
+				attrs = append(attrs, "user_id", info.UserId)
+			}
+
+			if v != nil {
+				slog.Error("request", append(attrs, "panic", fmt.Sprint(v))...)
+				panic(v)
+			}
+			slog.Info("request", attrs...)
+		}()
+
+		mux.ServeHTTP(sw, r)
+	})
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, less func(a, b K) bool) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+
+	return keys
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+
+	fmt.Fprintln(w, "# HELP moleguard_http_requests_total HTTP requests by route and status code.")
+	fmt.Fprintln(w, "# TYPE moleguard_http_requests_total counter")
+	for _, k := range sortedKeys(requestCounts, func(a, b routeKey) bool {
+		return a.Route < b.Route || (a.Route == b.Route && a.Code < b.Code)
+	}) {
+		fmt.Fprintf(w, "moleguard_http_requests_total{route=%q,code=\"%d\"} %d\n", k.Route, k.Code, requestCounts[k])
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE moleguard_http_request_duration_seconds histogram")
+	for _, route := range sortedKeys(requestDurations, func(a, b string) bool { return a < b }) {
+		requestDurations[route].write(w, "moleguard_http_request_duration_seconds", fmt.Sprintf("route=%q", route))
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_node_proxy_errors_total Failed requests to nodes.")
+	fmt.Fprintln(w, "# TYPE moleguard_node_proxy_errors_total counter")
+	for _, node := range sortedKeys(nodeProxyErrors, func(a, b string) bool { return a < b }) {
+		fmt.Fprintf(w, "moleguard_node_proxy_errors_total{node=%q} %d\n", node, nodeProxyErrors[node])
+	}
+
+	fetchedAt := relaysFetchedAt
+	metricsMu.Unlock()
+
+	if !fetchedAt.IsZero() {
+		fmt.Fprintln(w, "# HELP moleguard_relay_catalogue_age_seconds Seconds since the relay catalogue was fetched.")
+		fmt.Fprintln(w, "# TYPE moleguard_relay_catalogue_age_seconds gauge")
+		fmt.Fprintf(w, "moleguard_relay_catalogue_age_seconds %d\n", int64(time.Since(fetchedAt).Seconds()))
+	}
+
+	rows, err := db.Query("select d.node, u.id, count(*) from device d join users u on u.token = d.user_token group by d.node, u.id order by d.node, u.id")
+	if err != nil {
+		slog.Error("failed to count devices", "err", err)
+		return
+	}
+
+	defer rows.Close()
+
+	fmt.Fprintln(w, "# HELP moleguard_devices Devices by node and user.")
+	fmt.Fprintln(w, "# TYPE moleguard_devices gauge")
+	for rows.Next() {
+		var node string
+		var userId int64
+		var count int
+		check(rows.Scan(&node, &userId, &count))
+
+		fmt.Fprintf(w, "moleguard_devices{node=%q,user_id=\"%d\"} %d\n", node, userId, count)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// users can log in through an OpenID Connect provider with the authorization
+// code flow and PKCE. They are provisioned on their first login, their groups
+// decide on every login which nodes they see and whether they are admins or
+// relay operators. ID tokens are checked against the provider's RS256 keys.
+// The provider's login doesn't replace the TOTP second factor, users who
+// enabled it enter a code before their session starts.
+
+// oidcPendingCookie holds a login that waits for the second factor
+const oidcPendingCookie = "moleguard_oidc_pending"
+
+type OidcConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectUrl is where the provider sends the browser back, it ends in /oidc/callback
+	RedirectUrl string `json:"redirect_url"`
+	// Scopes default to openid, profile and groups
+	Scopes []string `json:"scopes"`
+	// GroupsClaim is the claim holding the user's groups (default groups)
+	GroupsClaim         string   `json:"groups_claim"`
+	AdminGroups         []string `json:"admin_groups"`
+	RelayOperatorGroups []string `json:"relay_operator_groups"`
+	// NodeGroups maps a group to the nodes its members see, without it
+	// every user sees every node
+	NodeGroups map[string][]string `json:"node_groups"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type oidcPending struct {
+	userId  int64
+	expires time.Time
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type oidcProvider struct {
+	config    OidcConfig
+	client    *http.Client
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+	// logins in progress by state, they expire after ten minutes
+	logins map[string]oidcLogin
+	// logins waiting for the second factor by the hash of their cookie, they
+	// expire after five minutes
+	pending map[string]oidcPending
+}
+
+func newOidcProvider(config OidcConfig) *oidcProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "groups"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	return &oidcProvider{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    map[string]*rsa.PublicKey{},
+		logins:  map[string]oidcLogin{},
+		pending: map[string]oidcPending{},
+	}
+}
+
+func (p *oidcProvider) getJson(u string, v any) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %d", u, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover loads the provider's configuration once
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	err := p.getJson(strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("provider claims to be %s", discovery.Issuer)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// key returns the signing key with the id, the key set is reloaded for unknown ids
+func (p *oidcProvider) key(discovery *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJson(discovery.JwksUri, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// authUrl starts a login and returns where to send the browser
+func (p *oidcProvider) authUrl() (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	state, login := randomToken(), oidcLogin{verifier: randomToken(), nonce: randomToken(), expires: time.Now().Add(10 * time.Minute)}
+
+	p.mu.Lock()
+	for s, l := range p.logins {
+		if time.Now().After(l.expires) {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = login
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientId},
+		"redirect_uri":          {p.config.RedirectUrl},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return discovery.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// verifyIdToken checks the signature and the claims of an ID token and returns its claims
+func (p *oidcProvider) verifyIdToken(discovery *oidcDiscovery, token string, nonce string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headerJson, &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+	}
+
+	key, err := p.key(discovery, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(claimsJson, &claims); err != nil {
+		return nil, err
+	}
+
+	if claims["iss"] != discovery.Issuer {
+		return nil, errors.New("id token from another issuer")
+	}
+
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == p.config.ClientId
+	case []any:
+		audience = slices.Contains(aud, any(p.config.ClientId))
+	}
+	if !audience {
+		return nil, errors.New("id token for another client")
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id token expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("id token without subject")
+	}
+
+	return claims, nil
+}
+
+// exchange redeems the authorization code and returns the verified claims of the ID token
+func (p *oidcProvider) exchange(state string, code string) (map[string]any, error) {
+	p.mu.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(login.expires) {
+		return nil, errors.New("unknown or expired login")
+	}
+
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectUrl},
+		"client_id":     {p.config.ClientId},
+		"code_verifier": {login.verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	resp, err := p.client.PostForm(discovery.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: unexpected status %d: %s", resp.StatusCode, body)
+	}
+
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, err
+	}
+
+	return p.verifyIdToken(discovery, tokens.IdToken, login.nonce)
+}
+
+func claimGroups(claims map[string]any, claim string) []string {
+	var groups []string
+	switch value := claims[claim].(type) {
+	case []any:
+		for _, group := range value {
+			if group, ok := group.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	case string:
+		groups = strings.Fields(value)
+	}
+	return groups
+}
+
+// provision creates the user of the claims on the first login and applies
+// the roles and nodes of their groups, it returns the user's id
+func (p *oidcProvider) provision(claims map[string]any, nodes map[string]NodeConfig) (int64, error) {
+	subject := claims["sub"].(string)
+	groups := claimGroups(claims, p.config.GroupsClaim)
+
+	inAny := func(wanted []string) bool {
+		for _, group := range groups {
+			if slices.Contains(wanted, group) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var allowed sql.NullString
+	if len(p.config.NodeGroups) != 0 {
+		var names []string
+		for _, group := range groups {
+			for _, node := range p.config.NodeGroups[group] {
+				if _, ok := nodes[node]; ok && !slices.Contains(names, node) {
+					names = append(names, node)
+				}
+			}
+		}
+		slices.Sort(names)
+		allowed = sql.NullString{String: strings.Join(names, ","), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	err = tx.QueryRow("select id from users where oidc_subject = ?", subject).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the user token stays unknown to the user, the daemon gets an API token
+		res, err := tx.Exec("insert into users(token, oidc_subject) values(?, ?)", randomToken(), subject)
+		if err != nil {
+			return 0, err
+		}
+		rowId, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		err = tx.QueryRow("select id from users where rowid = ?", rowId).Scan(&userId)
+		if err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("update users set admin = ?, relay_operator = ?, nodes = ? where id = ?",
+		inAny(p.config.AdminGroups), inAny(p.config.RelayOperatorGroups), allowed, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, tx.Commit()
+}
+
+// holdForSecondFactor keeps the user's login until the browser sends a code
+func (p *oidcProvider) holdForSecondFactor(w http.ResponseWriter, r *http.Request, userId int64) {
+	id, expires := randomToken(), time.Now().Add(5*time.Minute)
+
+	p.mu.Lock()
+	for s, l := range p.pending {
+		if time.Now().After(l.expires) {
+			delete(p.pending, s)
+		}
+	}
+	p.pending[hashToken(id)] = oidcPending{userId: userId, expires: expires}
+	p.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcPendingCookie,
+		Value:    id,
+		Path:     "/oidc/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// pendingUser returns the user of the request's login waiting for the second factor
+func (p *oidcProvider) pendingUser(r *http.Request) (int64, bool) {
+	cookie, err := r.Cookie(oidcPendingCookie)
+	if err != nil {
+		return 0, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, ok := p.pending[hashToken(cookie.Value)]
+	if !ok || time.Now().After(pending.expires) {
+		return 0, false
+	}
+	return pending.userId, true
+}
+
+// releaseSecondFactor ends the request's waiting login and clears its cookie
+func (p *oidcProvider) releaseSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(oidcPendingCookie); err == nil {
+		p.mu.Lock()
+		delete(p.pending, hashToken(cookie.Value))
+		p.mu.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcPendingCookie,
+		Value:    "",
+		Path:     "/oidc/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
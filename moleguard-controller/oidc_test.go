@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestVerifyIdToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kid: "key-1",
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	issuer := "https://id.example.com"
+	discovery := &oidcDiscovery{Issuer: issuer, JwksUri: jwks.URL}
+
+	sign := func(header map[string]any, claims map[string]any, signer *rsa.PrivateKey) string {
+		headerJson, _ := json.Marshal(header)
+		claimsJson, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	header := func(alg string, kid string) map[string]any {
+		return map[string]any{"alg": alg, "kid": kid}
+	}
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   issuer,
+			"aud":   "moleguard",
+			"sub":   "alice",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "nonce",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(header("RS256", "key-1"), claims(nil), key), true},
+		{"audience list", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["aud"] = []string{"other", "moleguard"}
+		}), key), true},
+		{"expired within the leeway", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["exp"] = time.Now().Add(-30 * time.Second).Unix()
+		}), key), true},
+		{"malformed", "not.a-token", false},
+		{"unsigned", sign(header("none", "key-1"), claims(nil), key), false},
+		{"symmetric algorithm", sign(header("HS256", "key-1"), claims(nil), key), false},
+		{"unknown key", sign(header("RS256", "key-2"), claims(nil), key), false},
+		{"signed by another key", sign(header("RS256", "key-1"), claims(nil), otherKey), false},
+		{"another issuer", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["iss"] = "https://evil.example.com"
+		}), key), false},
+		{"another audience", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["aud"] = "other"
+		}), key), false},
+		{"audience list without the client", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["aud"] = []string{"other"}
+		}), key), false},
+		{"no audience", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			delete(c, "aud")
+		}), key), false},
+		{"expired", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+		}), key), false},
+		{"no expiry", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			delete(c, "exp")
+		}), key), false},
+		{"another nonce", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			c["nonce"] = "replayed"
+		}), key), false},
+		{"no nonce", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			delete(c, "nonce")
+		}), key), false},
+		{"no subject", sign(header("RS256", "key-1"), claims(func(c map[string]any) {
+			delete(c, "sub")
+		}), key), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newOidcProvider(OidcConfig{Issuer: issuer, ClientId: "moleguard"})
+
+			got, err := p.verifyIdToken(discovery, tt.token, "nonce")
+			if (err == nil) != tt.ok {
+				t.Fatalf("verifyIdToken() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && got["sub"] != "alice" {
+				t.Fatalf("verifyIdToken() returned the claims %v", got)
+			}
+		})
+	}
+}
+
+func TestClaimGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		groups []string
+	}{
+		{"list", map[string]any{"groups": []any{"vpn-users", "vpn-admins"}}, []string{"vpn-users", "vpn-admins"}},
+		{"list with other values", map[string]any{"groups": []any{"vpn-users", 42, nil}}, []string{"vpn-users"}},
+		{"space separated", map[string]any{"groups": "vpn-users  vpn-admins"}, []string{"vpn-users", "vpn-admins"}},
+		{"missing", map[string]any{}, nil},
+		{"another type", map[string]any{"groups": 42.0}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if groups := claimGroups(tt.claims, "groups"); !slices.Equal(groups, tt.groups) {
+				t.Fatalf("claimGroups() = %v, want %v", groups, tt.groups)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// qrSvg renders the TOTP provisioning URI as a QR code with error correction
+// level M, the bitmap includes a quiet zone of four modules
+func qrSvg(data string, scale int) (string, error) {
+	code, err := qrcode.New(data, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+
+	modules := code.Bitmap()
+	size := len(modules)
+
+	var path strings.Builder
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size*scale, size*scale, size, size, path.String()), nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RelayChange struct {
+	Server string `json:"server"`
+	Entry  string `json:"entry,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type RelayHistoryEntry struct {
+	Id     int64     `json:"id"`
+	UserId int64     `json:"user_id"`
+	Server string    `json:"server"`
+	Entry  string    `json:"entry,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Status int       `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// relayLocks holds a lock per node, a relay change holds it until the node answered
+var relayLocks = map[string]*sync.Mutex{}
+
+// lastRelayChange is when the relay of a node was last changed successfully
+var lastRelayChange = map[string]time.Time{}
+var lastRelayChangeMu sync.Mutex
+
+func relayCooldownLeft(node string, cooldown time.Duration) time.Duration {
+	lastRelayChangeMu.Lock()
+	defer lastRelayChangeMu.Unlock()
+
+	return cooldown - time.Since(lastRelayChange[node])
+}
+
+// recordRelayChange stores who changed the relay of a node and starts the cooldown if it succeeded
+func recordRelayChange(node string, userId int64, change RelayChange, status int) {
+	recordRelayChangeAt(node, userId, change, status, time.Now())
+}
+
+func recordRelayChangeAt(node string, userId int64, change RelayChange, status int, at time.Time) {
+	_, err := db.Exec("insert into relay_history(node, user_id, server, entry, reason, status, created_at) values(?, ?, ?, ?, ?, ?, ?)",
+		node, userId, change.Server, change.Entry, change.Reason, status, at.Unix())
+	if err != nil {
+		slog.Error("failed to record relay change", "node", node, "err", err)
+	}
+
+	slog.Info("relay change", "node", node, "user_id", userId, "server", change.Server, "entry", change.Entry, "reason", change.Reason, "status", status)
+
+	if status == 200 {
+		lastRelayChangeMu.Lock()
+		if at.After(lastRelayChange[node]) {
+			lastRelayChange[node] = at
+		}
+		lastRelayChangeMu.Unlock()
+
+		emit(EventRelayChanged, RelayEvent{Node: node, UserId: userId, Server: change.Server, Entry: change.Entry, Reason: change.Reason})
+	} else {
+		emit(EventRelayFailed, RelayEvent{Node: node, UserId: userId, Server: change.Server, Entry: change.Entry, Reason: change.Reason})
+	}
+}
+
+// nodes keep their rotation schedule, the controller runs the due rotations so
+// they take the relay lock and wait out the cooldown like manual changes
+const rotationCheckInterval = 15 * time.Second
+
+type RotationSchedule struct {
+	Policy struct {
+		Enabled bool `json:"enabled"`
+	} `json:"policy"`
+	NextRotation time.Time `json:"next_rotation"`
+	// Scheduler is "node" for nodes that run their rotations themselves
+	Scheduler string `json:"scheduler"`
+}
+
+func rotationDue(node NodeConfig) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.Host+"/rotation", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", node.Token)
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return false, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var schedule RotationSchedule
+	if err := json.NewDecoder(resp.Body).Decode(&schedule); err != nil {
+		return false, err
+	}
+
+	if schedule.Scheduler == "node" {
+		return false, nil
+	}
+	return schedule.Policy.Enabled && !schedule.NextRotation.IsZero() && time.Now().After(schedule.NextRotation), nil
+}
+
+// rotateNode runs a due rotation, a busy lock or the cooldown leave it for a later round
+func rotateNode(node NodeConfig, cooldown time.Duration) {
+	lock := relayLocks[node.Name]
+	if !lock.TryLock() {
+		return
+	}
+	defer lock.Unlock()
+
+	if relayCooldownLeft(node.Name, cooldown) > 0 {
+		return
+	}
+
+	req, err := http.NewRequest("POST", "http://"+node.Host+"/rotation/rotate", nil)
+	check(err)
+
+	req.Header.Set("Authorization", node.Token)
+
+	change := RelayChange{Reason: "rotation"}
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		recordRelayChange(node.Name, 0, change, http.StatusBadGateway)
+		return
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		recordRelayChange(node.Name, 0, change, http.StatusBadGateway)
+		return
+	}
+
+	// rotation was disabled in the meantime or the node is switching already
+	if resp.StatusCode == http.StatusConflict {
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		json.Unmarshal(body, &change)
+		change.Reason = "rotation"
+	}
+
+	recordRelayChange(node.Name, 0, change, resp.StatusCode)
+}
+
+// NodeSwitch is a relay switch from the node's own history
+type NodeSwitch struct {
+	To     string    `json:"to"`
+	Entry  string    `json:"entry"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+}
+
+// nodeSwitchesSeen is the time of the last switch imported per node
+var nodeSwitchesSeen = map[string]time.Time{}
+
+// importNodeSwitches records the switches nodes make on their own, like
+// reconnects, key rotations and automatic relay choices. They start the
+// cooldown like the changes made through the controller, which are not
+// imported again.
+func importNodeSwitches(node NodeConfig) error {
+	seen, ok := nodeSwitchesSeen[node.Name]
+	if !ok {
+		var last int64
+		err := db.QueryRow("select coalesce(max(created_at), 0) from relay_history where node = ?", node.Name).Scan(&last)
+		if err != nil {
+			return err
+		}
+		// created_at has second precision, the switch stored last is not imported again
+		seen = time.Unix(last, 0).Add(time.Second - 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+node.Host+"/relay/history", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", node.Token)
+
+	resp, err := nodeDo(node, req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var switches []NodeSwitch
+	if err := json.NewDecoder(resp.Body).Decode(&switches); err != nil {
+		return err
+	}
+
+	for _, sw := range switches {
+		if !sw.At.After(seen) {
+			continue
+		}
+		seen = sw.At
+
+		if sw.Reason == "rotation" || sw.Reason == "manual" || strings.HasPrefix(sw.Reason, "manual: ") {
+			continue
+		}
+
+		status := http.StatusOK
+		if sw.Error != "" {
+			status = http.StatusBadGateway
+		}
+		recordRelayChangeAt(node.Name, 0, RelayChange{Server: sw.To, Entry: sw.Entry, Reason: sw.Reason}, status, sw.At)
+	}
+
+	nodeSwitchesSeen[node.Name] = seen
+	return nil
+}
+
+// relayLoop imports the nodes' own switches and runs their due rotations
+func relayLoop(config Config, cooldown time.Duration) {
+	for {
+		for name, node := range config.Nodes {
+			if err := importNodeSwitches(node); err != nil {
+				slog.Warn("failed to import the relay history", "node", name, "err", err)
+			}
+
+			due, err := rotationDue(node)
+			if err != nil {
+				slog.Warn("failed to get the rotation schedule", "node", name, "err", err)
+				continue
+			}
+
+			if due {
+				rotateNode(node, cooldown)
+			}
+		}
+
+		time.Sleep(rotationCheckInterval)
+	}
+}
+
+// relayHistory returns the most recent relay changes of a node, newest first
+func relayHistory(node string, limit int) ([]RelayHistoryEntry, error) {
+	rows, err := db.Query("select id, user_id, server, entry, reason, status, created_at from relay_history where node = ? order by id desc limit ?", node, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := []RelayHistoryEntry{}
+	for rows.Next() {
+		var entry RelayHistoryEntry
+		var at int64
+		if err := rows.Scan(&entry.Id, &entry.UserId, &entry.Server, &entry.Entry, &entry.Reason, &entry.Status, &at); err != nil {
+			return nil, err
+		}
+		entry.At = time.Unix(at, 0)
+
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// browsers log in with a session instead of keeping the user token around.
+// The session id lives in an HttpOnly cookie and only its hash is stored,
+// requests authenticated by the cookie that change anything also carry the
+// session's CSRF token in the X-CSRF-Token header.
+
+const sessionCookie = "moleguard_session"
+const csrfHeader = "X-CSRF-Token"
+
+type Session struct {
+	UserId    int64     `json:"user_id"`
+	CsrfToken string    `json:"csrf_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type sessionKey struct{}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// secureRequest tells whether the browser talks https to us or to the proxy in front of us
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// createSession starts a session for the user and sets its cookie
+func createSession(w http.ResponseWriter, r *http.Request, userId int64, ttl time.Duration) (*Session, error) {
+	_, err := db.Exec("delete from session where expires_at < ?", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	id := randomToken()
+	session := &Session{UserId: userId, CsrfToken: randomToken(), ExpiresAt: time.Now().Add(ttl)}
+
+	_, err = db.Exec("insert into session(id, user_id, csrf_token, created_at, expires_at) values(?, ?, ?, ?, ?)",
+		hashToken(id), userId, session.CsrfToken, time.Now().Unix(), session.ExpiresAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return session, nil
+}
+
+// lookupSession returns the session of the request's cookie and its user, nil if there is none or it expired
+func lookupSession(r *http.Request) (*Session, *User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	session := &Session{}
+	user := &User{}
+	var expiresAt int64
+	err = db.QueryRow(`select session.user_id, session.csrf_token, session.expires_at, users.token, users.relay_operator, users.admin, users.nodes
+		from session join users on users.id = session.user_id
+		where session.id = ? and session.expires_at >= ?`, hashToken(cookie.Value), time.Now().Unix()).
+		Scan(&session.UserId, &session.CsrfToken, &expiresAt, &user.Token, &user.RelayOperator, &user.Admin, &user.Nodes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	user.Id = session.UserId
+
+	return session, user, nil
+}
+
+func currentSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionKey{}).(*Session)
+	return session
+}
+
+// csrfSafe tells whether a request authenticated by a session may go ahead
+func csrfSafe(r *http.Request, session *Session) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	token := r.Header.Get(csrfHeader)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CsrfToken)) == 1
+}
+
+// endSession invalidates the request's session and clears its cookie
+func endSession(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		_, err := db.Exec("delete from session where id = ?", hashToken(cookie.Value))
+		if err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
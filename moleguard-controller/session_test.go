@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCsrfSafe(t *testing.T) {
+	session := &Session{CsrfToken: "csrf-token"}
+
+	tests := []struct {
+		method string
+		token  string
+		safe   bool
+	}{
+		{"GET", "", true},
+		{"HEAD", "", true},
+		{"OPTIONS", "", true},
+		{"POST", "csrf-token", true},
+		{"POST", "", false},
+		{"POST", "other-token", false},
+		{"POST", "csrf-token-and-more", false},
+		{"PUT", "", false},
+		{"PATCH", "csrf-token", true},
+		{"DELETE", "", false},
+		{"DELETE", "csrf-token", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		if tt.token != "" {
+			r.Header.Set(csrfHeader, tt.token)
+		}
+
+		if safe := csrfSafe(r, session); safe != tt.safe {
+			t.Errorf("%s with token %q: csrfSafe() = %v, want %v", tt.method, tt.token, safe, tt.safe)
+		}
+	}
+
+	// a session without a token never passes
+	r := httptest.NewRequest("POST", "/", nil)
+	if csrfSafe(r, &Session{}) {
+		t.Error("csrfSafe() passed a request without a token for a session without one")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API tokens stand in for the user token in scripts and the daemon. A user
+// can have several named tokens, each limited to some scopes and optionally
+// expiring. Tokens without scopes have full access, like the user token.
+// nodes:write changes the rotation policy and the settings of a node,
+// relay:write only its relay.
+
+const (
+	scopeNodesRead    = "nodes:read"
+	scopeNodesWrite   = "nodes:write"
+	scopeDevicesRead  = "devices:read"
+	scopeDevicesWrite = "devices:write"
+	scopeRelayWrite   = "relay:write"
+	scopeAdmin        = "admin"
+	// scopeAny is for routes every token may use, like revoking itself
+	scopeAny = "*"
+)
+
+var tokenScopes = []string{scopeNodesRead, scopeNodesWrite, scopeDevicesRead, scopeDevicesWrite, scopeRelayWrite, scopeAdmin}
+
+// daemonScopes are what the daemon needs to list nodes and follow its devices
+var daemonScopes = []string{scopeNodesRead, scopeDevicesRead}
+
+type ApiToken struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	// Scopes are nil for full access
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+type CreatedApiToken struct {
+	ApiToken
+	// Token is only shown once, only its hash is stored
+	Token string `json:"token"`
+}
+
+type ApiTokenReq struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a duration like 720h, without it the token doesn't expire
+	ExpiresIn string `json:"expires_in"`
+}
+
+type TokenRevocation struct {
+	// Revoked is session or api_token, the user token is rotated instead
+	Revoked string `json:"revoked"`
+}
+
+type TokenById struct {
+	TokenId int64 `json:"token_id"`
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func unixTime(t int64) *time.Time {
+	if t == 0 {
+		return nil
+	}
+	u := time.Unix(t, 0)
+	return &u
+}
+
+func splitScopes(scopes sql.NullString) []string {
+	if !scopes.Valid {
+		return nil
+	}
+	split := strings.FieldsFunc(scopes.String, func(r rune) bool { return r == ',' })
+	if split == nil {
+		// an empty list must not turn into full access
+		split = []string{}
+	}
+	return split
+}
+
+// validate checks the request and returns when the token expires, zero for never
+func (req *ApiTokenReq) validate() (time.Time, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		return time.Time{}, errors.New("the name must have 1 to 64 characters")
+	}
+
+	if len(req.Scopes) == 0 {
+		return time.Time{}, errors.New("a token needs at least one scope")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			return time.Time{}, fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	if req.ExpiresIn == "" {
+		return time.Time{}, nil
+	}
+	expiresIn, err := time.ParseDuration(req.ExpiresIn)
+	if err != nil || expiresIn <= 0 {
+		return time.Time{}, errors.New("expires_in must be a positive duration")
+	}
+
+	return time.Now().Add(expiresIn), nil
+}
+
+// insertApiToken stores a new token, nil scopes give it full access
+func insertApiToken(db execer, userId int64, name string, scopes []string, expiresAt time.Time) (*CreatedApiToken, error) {
+	created := &CreatedApiToken{
+		ApiToken: ApiToken{Name: name, Scopes: scopes, CreatedAt: time.Now()},
+		Token:    randomToken(),
+	}
+
+	var scopesCol sql.NullString
+	if scopes != nil {
+		scopesCol = sql.NullString{String: strings.Join(scopes, ","), Valid: true}
+	}
+	var expiresCol int64
+	if !expiresAt.IsZero() {
+		expiresCol = expiresAt.Unix()
+		created.ExpiresAt = &expiresAt
+	}
+
+	res, err := db.Exec("insert into api_token(user_id, token_hash, name, scopes, created_at, expires_at, last_used) values(?, ?, ?, ?, ?, ?, 0)",
+		userId, hashToken(created.Token), name, scopesCol, created.CreatedAt.Unix(), expiresCol)
+	if err != nil {
+		return nil, err
+	}
+
+	created.Id, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// createApiToken issues a token for the daemon and the API, it is only shown once
+func createApiToken(userId int64, name string, scopes []string, expiresAt time.Time) (*CreatedApiToken, error) {
+	return insertApiToken(db, userId, name, scopes, expiresAt)
+}
+
+// listApiTokens returns the user's tokens, expired ones included
+func listApiTokens(userId int64) ([]ApiToken, error) {
+	rows, err := db.Query("select id, name, scopes, created_at, expires_at, last_used from api_token where user_id = ? order by id", userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		var token ApiToken
+		var scopes sql.NullString
+		var createdAt, expiresAt, lastUsed int64
+		err = rows.Scan(&token.Id, &token.Name, &scopes, &createdAt, &expiresAt, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+
+		token.Scopes = splitScopes(scopes)
+		token.CreatedAt = time.Unix(createdAt, 0)
+		token.ExpiresAt = unixTime(expiresAt)
+		token.LastUsed = unixTime(lastUsed)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// revokeApiToken deletes one of the user's tokens, it returns false if the user has no such token
+func revokeApiToken(userId int64, id int64) (bool, error) {
+	res, err := db.Exec("delete from api_token where id = ? and user_id = ?", id, userId)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n != 0, err
+}
+
+// lookupApiToken returns the user of an unexpired API token, nil if there is none
+func lookupApiToken(token string) (*User, error) {
+	now := time.Now().Unix()
+
+	user := &User{ApiToken: true}
+	var id int64
+	var scopes sql.NullString
+	err := db.QueryRow(`select api_token.id, api_token.scopes, users.id, users.token, users.relay_operator, users.admin, users.nodes
+		from api_token join users on users.id = api_token.user_id
+		where api_token.token_hash = ? and (api_token.expires_at = 0 or api_token.expires_at > ?)`, hashToken(token), now).
+		Scan(&id, &scopes, &user.Id, &user.Token, &user.RelayOperator, &user.Admin, &user.Nodes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.Scopes = splitScopes(scopes)
+
+	// a minute is precise enough and keeps busy tokens from writing on every request
+	_, err = db.Exec("update api_token set last_used = ? where id = ? and last_used < ?", now, id, now-60)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// rotateUserToken gives the user a new token and moves their devices over to it.
+// The other sessions end, one could have been started with the leaked token.
+func rotateUserToken(userId int64, keepSession string) (string, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.QueryRow("select token from users where id = ?", userId).Scan(&old)
+	if err != nil {
+		return "", err
+	}
+
+	token := randomToken()
+	_, err = tx.Exec("update users set token = ? where id = ?", token, userId)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("update device set user_token = ? where user_token = ?", token, old)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("delete from session where user_id = ? and id != ?", userId, keepSession)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// revokeApiTokenByValue deletes the API token, it returns false if there is no such token
+func revokeApiTokenByValue(token string) (bool, error) {
+	res, err := db.Exec("delete from api_token where token_hash = ?", hashToken(token))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n != 0, err
+}
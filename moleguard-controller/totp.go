@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as in RFC 6238 with the defaults authenticator apps expect: SHA1,
+// six digits and a 30 second step. A code is accepted one step early or
+// late, and a step that was used once is never accepted again. Every few
+// invalid codes in a row lock the second factor for a while, the lockout
+// doubles each time.
+
+const totpStep = 30
+const totpIssuer = "Moleguard"
+const recoveryCodeCount = 10
+const totpMaxFailures = 5
+const totpLockout = 5 * time.Minute
+const totpMaxLockout = 24 * time.Hour
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+	QrSvg  string `json:"qr_svg"`
+}
+
+type TotpConfirmation struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	// ApiToken replaces the user token for API and daemon access, which no longer works alone
+	ApiToken string `json:"api_token"`
+}
+
+type TotpCode struct {
+	Code string `json:"code"`
+}
+
+var errInvalidCode = errors.New("invalid second factor")
+var errTotpLocked = errors.New("too many invalid codes, try again later")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTotp returns the step the code belongs to, it only looks at steps after lastStep
+func matchTotp(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != 6 {
+		return 0, false
+	}
+
+	now := time.Now().Unix() / totpStep
+	for step := now - 1; step <= now+1; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpUri(userId int64, secret string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:user-%d", totpIssuer, userId))
+	query := url.Values{"secret": {secret}, "issuer": {totpIssuer}}
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// enrollTotp stores a new secret for the user, it is used once a code confirms it
+func enrollTotp(userId int64) (*TotpEnrollment, error) {
+	key := make([]byte, 20)
+	rand.Read(key)
+	secret := totpEncoding.EncodeToString(key)
+
+	_, err := db.Exec("update users set totp_secret = ?, totp_enabled = 0, totp_last_step = 0 where id = ?", secret, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment := &TotpEnrollment{Secret: secret, Uri: totpUri(userId, secret)}
+	enrollment.QrSvg, err = qrSvg(enrollment.Uri, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+func totpEnabled(userId int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("select totp_enabled from users where id = ?", userId).Scan(&enabled)
+	return enabled, err
+}
+
+// lockoutAfter returns how long the second factor is locked after the failures, zero for not at all
+func lockoutAfter(failures int) time.Duration {
+	if failures%totpMaxFailures != 0 {
+		return 0
+	}
+
+	lockout := totpLockout
+	for i := totpMaxFailures; i < failures && lockout < totpMaxLockout; i += totpMaxFailures {
+		lockout *= 2
+	}
+	return min(lockout, totpMaxLockout)
+}
+
+// verifySecondFactor accepts a TOTP code or an unused recovery code of the user.
+// No code is accepted while the second factor is locked.
+func verifySecondFactor(userId int64, code string) error {
+	code = strings.TrimSpace(code)
+	now := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep, lockedUntil int64
+	var failures int
+	err = tx.QueryRow("select totp_secret, totp_last_step, totp_failures, totp_locked_until from users where id = ?", userId).
+		Scan(&secret, &lastStep, &failures, &lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	if now.Unix() < lockedUntil {
+		return errTotpLocked
+	}
+
+	if step, ok := matchTotp(secret, code, lastStep); ok {
+		_, err = tx.Exec("update users set totp_last_step = ?, totp_failures = 0, totp_locked_until = 0 where id = ?", step, userId)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	res, err := tx.Exec("update recovery_code set used_at = ? where user_id = ? and code_hash = ? and used_at = 0",
+		now.Unix(), userId, hashToken(strings.ToLower(code)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 0 {
+		_, err = tx.Exec("update users set totp_failures = 0, totp_locked_until = 0 where id = ?", userId)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	failures++
+	lockout := lockoutAfter(failures)
+	if lockout != 0 {
+		lockedUntil = now.Add(lockout).Unix()
+	}
+
+	_, err = tx.Exec("update users set totp_failures = ?, totp_locked_until = ? where id = ?", failures, lockedUntil, userId)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if lockout == 0 {
+		return errInvalidCode
+	}
+
+	slog.Warn("second factor locked", "user_id", userId, "failures", failures, "lockout", lockout)
+	recordAudit(&AuditEntry{At: now, UserId: userId, Action: "user.totp_lockout", Outcome: "denied", Status: http.StatusTooManyRequests})
+
+	return errTotpLocked
+}
+
+// confirmTotp enables the enrolled secret once the user proved to have it,
+// the recovery codes and the API token are only shown this once
+func confirmTotp(userId int64, code string) (*TotpConfirmation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabled bool
+	err = tx.QueryRow("select totp_secret, totp_enabled from users where id = ?", userId).Scan(&secret, &enabled)
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" || enabled {
+		return nil, errors.New("no pending enrollment")
+	}
+
+	step, ok := matchTotp(secret, strings.TrimSpace(code), 0)
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	_, err = tx.Exec("update users set totp_enabled = 1, totp_last_step = ? where id = ?", step, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation := &TotpConfirmation{}
+
+	_, err = tx.Exec("delete from recovery_code where user_id = ?", userId)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := hex.EncodeToString(b)
+
+		_, err = tx.Exec("insert into recovery_code(user_id, code_hash, used_at) values(?, ?, 0)", userId, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+		confirmation.RecoveryCodes = append(confirmation.RecoveryCodes, code)
+	}
+
+	token, err := insertApiToken(tx, userId, "api", nil, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	confirmation.ApiToken = token.Token
+
+	return confirmation, tx.Commit()
+}
+
+// disableTotp removes the second factor, the API tokens keep working
+func disableTotp(userId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("update users set totp_secret = '', totp_enabled = 0, totp_last_step = 0, totp_failures = 0, totp_locked_until = 0 where id = ?", userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from recovery_code where user_id = ?", userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
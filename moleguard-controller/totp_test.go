@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors of RFC 6238, truncated to six digits
+func TestTotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		at   int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if code := totpCode(secret, tt.at/totpStep); code != tt.code {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.at, code, tt.code)
+		}
+	}
+}
+
+// currentStep returns the TOTP step, waiting out the end of a step so the
+// codes of a test don't cross into the next one
+func currentStep() int64 {
+	if totpStep-time.Now().Unix()%totpStep < 2 {
+		time.Sleep(2 * time.Second)
+	}
+	return time.Now().Unix() / totpStep
+}
+
+func TestMatchTotp(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := totpEncoding.DecodeString(secret)
+	now := currentStep()
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current step", secret, totpCode(key, now), 0, now, true},
+		{"one step early", secret, totpCode(key, now-1), 0, now - 1, true},
+		{"one step late", secret, totpCode(key, now+1), 0, now + 1, true},
+		{"two steps early", secret, totpCode(key, now-2), 0, 0, false},
+		{"two steps late", secret, totpCode(key, now+2), 0, 0, false},
+		{"used step", secret, totpCode(key, now), now, 0, false},
+		{"step before the used one", secret, totpCode(key, now-1), now, 0, false},
+		{"step after the used one", secret, totpCode(key, now+1), now, now + 1, true},
+		{"short code", secret, totpCode(key, now)[:5], 0, 0, false},
+		{"invalid secret", "not base32!", totpCode(key, now), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := matchTotp(tt.secret, tt.code, tt.lastStep)
+			if ok != tt.ok || step != tt.step {
+				t.Fatalf("matchTotp() = %d, %v, want %d, %v", step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLockoutAfter(t *testing.T) {
+	tests := []struct {
+		failures int
+		lockout  time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, 5 * time.Minute},
+		{6, 0},
+		{10, 10 * time.Minute},
+		{15, 20 * time.Minute},
+		{20, 40 * time.Minute},
+		{45, 21*time.Hour + 20*time.Minute},
+		{50, 24 * time.Hour},
+		{100, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if lockout := lockoutAfter(tt.failures); lockout != tt.lockout {
+			t.Errorf("lockoutAfter(%d) = %s, want %s", tt.failures, lockout, tt.lockout)
+		}
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	key, _ := totpEncoding.DecodeString(secret)
+
+	type attempt struct {
+		code string
+		err  error
+	}
+
+	tests := []struct {
+		name     string
+		failures int
+		attempts func(now int64) []attempt
+		// lockout is how long the second factor is locked after the attempts
+		lockout time.Duration
+	}{
+		{
+			name: "code is accepted once",
+			attempts: func(now int64) []attempt {
+				return []attempt{
+					{totpCode(key, now), nil},
+					{totpCode(key, now), errInvalidCode},
+					{totpCode(key, now-1), errInvalidCode},
+					{totpCode(key, now+1), nil},
+				}
+			},
+		},
+		{
+			name: "recovery code is accepted once",
+			attempts: func(now int64) []attempt {
+				return []attempt{
+					{" 0123456789 ", nil},
+					{"0123456789", errInvalidCode},
+				}
+			},
+		},
+		{
+			name: "recovery code is case insensitive",
+			attempts: func(now int64) []attempt {
+				return []attempt{{"ABCDEF0123", nil}}
+			},
+		},
+		{
+			name: "fifth invalid code locks",
+			attempts: func(now int64) []attempt {
+				return []attempt{
+					{"000000", errInvalidCode},
+					{"000000", errInvalidCode},
+					{"000000", errInvalidCode},
+					{"000000", errInvalidCode},
+					{"000000", errTotpLocked},
+					{totpCode(key, now), errTotpLocked},
+					{"0123456789", errTotpLocked},
+				}
+			},
+			lockout: 5 * time.Minute,
+		},
+		{
+			name:     "lockout doubles",
+			failures: 9,
+			attempts: func(now int64) []attempt {
+				return []attempt{{"000000", errTotpLocked}}
+			},
+			lockout: 10 * time.Minute,
+		},
+		{
+			name:     "valid code resets the failures",
+			failures: 4,
+			attempts: func(now int64) []attempt {
+				return []attempt{
+					{totpCode(key, now), nil},
+					{"000000", errInvalidCode},
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestDB(t)
+
+			userId := addTestUser(t, "token")
+			_, err := db.Exec("update users set totp_secret = ?, totp_enabled = 1, totp_failures = ? where id = ?", secret, tt.failures, userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, code := range []string{"0123456789", "abcdef0123"} {
+				_, err = db.Exec("insert into recovery_code(user_id, code_hash, used_at) values(?, ?, 0)", userId, hashToken(code))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			start := time.Now()
+			for i, a := range tt.attempts(currentStep()) {
+				if err := verifySecondFactor(userId, a.code); !errors.Is(err, a.err) {
+					t.Fatalf("attempt %d: verifySecondFactor(%q) = %v, want %v", i, a.code, err, a.err)
+				}
+			}
+
+			var lockedUntil int64
+			err = db.QueryRow("select totp_locked_until from users where id = ?", userId).Scan(&lockedUntil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.lockout == 0 {
+				if lockedUntil != 0 {
+					t.Fatalf("locked until %s, want unlocked", time.Unix(lockedUntil, 0))
+				}
+				return
+			}
+
+			want := start.Add(tt.lockout).Unix()
+			if lockedUntil < want-1 || lockedUntil > want+1 {
+				t.Fatalf("locked for %s, want %s", time.Until(time.Unix(lockedUntil, 0)).Round(time.Second), tt.lockout)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	EventNodeUnhealthy = "node.unhealthy"
+	EventNodeHealthy   = "node.healthy"
+	EventRelayChanging = "relay.changing"
+	EventRelayChanged  = "relay.changed"
+	EventRelayFailed   = "relay.failed"
+	EventDeviceCreated = "device.created"
+	EventDeviceDeleted = "device.deleted"
+	EventQuotaExceeded = "quota.exceeded"
+)
+
+// a delivery is given up after maxWebhookAttempts, the wait between attempts doubles up to an hour
+const maxWebhookAttempts = 6
+const webhookBackoff = 10 * time.Second
+
+type WebhookConfig struct {
+	// Name identifies the webhook in the deliveries, it must be unique
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// Secret signs "<X-Moleguard-Timestamp>.<payload>", see X-Moleguard-Signature.
+	// Receivers reject old timestamps so captured requests can't be replayed.
+	Secret string `json:"secret"`
+	// Events are the subscribed events, every event when empty
+	Events []string `json:"events"`
+}
+
+type WebhookPayload struct {
+	Id    string    `json:"id"`
+	Event string    `json:"event"`
+	At    time.Time `json:"at"`
+	Data  any       `json:"data"`
+}
+
+type WebhookDelivery struct {
+	Id      int64           `json:"id"`
+	Webhook string          `json:"webhook"`
+	Event   string          `json:"event"`
+	Payload json.RawMessage `json:"payload"`
+	// Status is pending, delivered or failed
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	LastStatus  int       `json:"last_status,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+type NodeEvent struct {
+	Node   string `json:"node"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type RelayEvent struct {
+	Node   string `json:"node"`
+	UserId int64  `json:"user_id"`
+	Server string `json:"server"`
+	Entry  string `json:"entry,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type DeviceEvent struct {
+	Node   string `json:"node"`
+	UserId int64  `json:"user_id"`
+	Device int    `json:"device"`
+	Ip     string `json:"ip,omitempty"`
+}
+
+type QuotaEvent struct {
+	UserId int64  `json:"user_id"`
+	Quota  string `json:"quota"`
+	Limit  int    `json:"limit"`
+}
+
+// webhooks are set once at startup
+var webhooks []WebhookConfig
+
+// every webhook has its own worker, a slow endpoint only holds up its own deliveries
+var webhookWake = map[string]chan struct{}{}
+
+var errWebhookNotConfigured = errors.New("the webhook is not configured")
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (webhook WebhookConfig) subscribed(event string) bool {
+	return len(webhook.Events) == 0 || slices.Contains(webhook.Events, event)
+}
+
+func lookupWebhook(name string) (WebhookConfig, bool) {
+	for _, webhook := range webhooks {
+		if webhook.Name == name {
+			return webhook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+func validateWebhooks(webhooks []WebhookConfig) error {
+	names := map[string]bool{}
+	for _, webhook := range webhooks {
+		if webhook.Name == "" || webhook.Url == "" {
+			return fmt.Errorf("webhooks need a name and an url")
+		}
+		if names[webhook.Name] {
+			return fmt.Errorf("duplicate webhook name: %s", webhook.Name)
+		}
+		names[webhook.Name] = true
+	}
+	return nil
+}
+
+// emit publishes the event to the event stream and queues a delivery for every subscribed webhook
+func emit(event string, data any) {
+	publish(event, data)
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	payload, err := json.Marshal(&WebhookPayload{
+		Id:    hex.EncodeToString(id),
+		Event: event,
+		At:    time.Now(),
+		Data:  data,
+	})
+	if err != nil {
+		slog.Error("failed to encode event", "event", event, "err", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.subscribed(event) {
+			continue
+		}
+
+		now := time.Now().Unix()
+		_, err := db.Exec("insert into webhook_delivery(webhook, event, payload, status, attempts, created_at, next_attempt) values(?, ?, ?, 'pending', 0, ?, ?)",
+			webhook.Name, event, string(payload), now, now)
+		if err != nil {
+			slog.Error("failed to queue webhook delivery", "webhook", webhook.Name, "event", event, "err", err)
+			continue
+		}
+		wakeWebhook(webhook.Name)
+	}
+}
+
+func wakeWebhook(name string) {
+	select {
+	case webhookWake[name] <- struct{}{}:
+	default:
+	}
+}
+
+// signPayload signs the timestamp with the payload, the timestamp can't be swapped for a newer one
+func signPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts a payload, it returns the status of the endpoint if it answered
+func sendWebhook(webhook WebhookConfig, delivery WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Moleguard-Event", delivery.Event)
+	req.Header.Set("X-Moleguard-Delivery", fmt.Sprintf("%d", delivery.Id))
+	if webhook.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Moleguard-Timestamp", timestamp)
+		req.Header.Set("X-Moleguard-Signature", signPayload(webhook.Secret, timestamp, delivery.Payload))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func deliver(webhook WebhookConfig, delivery WebhookDelivery) {
+	status, err := sendWebhook(webhook, delivery)
+
+	attempts := delivery.Attempts + 1
+	if err == nil {
+		_, err = db.Exec("update webhook_delivery set status = 'delivered', attempts = ?, last_status = ?, last_error = '' where id = ?", attempts, status, delivery.Id)
+		if err != nil {
+			slog.Error("failed to update webhook delivery", "id", delivery.Id, "err", err)
+		}
+		return
+	}
+
+	slog.Warn("webhook delivery failed", "id", delivery.Id, "webhook", delivery.Webhook, "event", delivery.Event, "attempt", attempts, "err", err)
+
+	next := "pending"
+	if attempts >= maxWebhookAttempts {
+		next = "failed"
+	}
+	backoff := min(webhookBackoff<<(attempts-1), time.Hour)
+
+	_, dbErr := db.Exec("update webhook_delivery set status = ?, attempts = ?, last_status = ?, last_error = ?, next_attempt = ? where id = ?",
+		next, attempts, status, err.Error(), time.Now().Add(backoff).Unix(), delivery.Id)
+	if dbErr != nil {
+		slog.Error("failed to update webhook delivery", "id", delivery.Id, "err", dbErr)
+	}
+}
+
+// deliverDue sends the pending deliveries of the webhook whose next attempt is due
+func deliverDue(webhook WebhookConfig) error {
+	deliveries, err := queryDeliveries("where webhook = ? and status = 'pending' and next_attempt <= ? order by id limit 50", webhook.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		deliver(webhook, delivery)
+	}
+
+	return nil
+}
+
+// webhookLoop sends the queued deliveries of the webhook, it also picks up
+// the ones left pending by a previous run
+func webhookLoop(webhook WebhookConfig, wake chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := deliverDue(webhook); err != nil {
+			slog.Error("failed to load webhook deliveries", "webhook", webhook.Name, "err", err)
+		}
+
+		select {
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// startWebhooks starts a worker per webhook. Deliveries left pending for a
+// webhook that is no longer configured fail, nothing would send them.
+func startWebhooks() error {
+	for _, webhook := range webhooks {
+		wake := make(chan struct{}, 1)
+		webhookWake[webhook.Name] = wake
+		go webhookLoop(webhook, wake)
+	}
+
+	rows, err := db.Query("select distinct webhook from webhook_delivery where status = 'pending'")
+	if err != nil {
+		return err
+	}
+
+	var orphaned []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := lookupWebhook(name); !ok {
+			orphaned = append(orphaned, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range orphaned {
+		_, err := db.Exec("update webhook_delivery set status = 'failed', last_error = ? where webhook = ? and status = 'pending'", errWebhookNotConfigured.Error(), name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func queryDeliveries(clause string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := db.Query("select id, webhook, event, payload, status, attempts, last_status, last_error, created_at, next_attempt from webhook_delivery "+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		var createdAt, nextAttempt int64
+		err := rows.Scan(&delivery.Id, &delivery.Webhook, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+			&delivery.LastStatus, &delivery.LastError, &createdAt, &nextAttempt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = json.RawMessage(payload)
+		delivery.CreatedAt = time.Unix(createdAt, 0)
+		delivery.NextAttempt = time.Unix(nextAttempt, 0)
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// replayDelivery queues a finished delivery again, it reports false when
+// there is no such delivery or it is still pending
+func replayDelivery(id int64) (bool, error) {
+	var name string
+	err := db.QueryRow("select webhook from webhook_delivery where id = ? and status != 'pending'", id).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if _, ok := lookupWebhook(name); !ok {
+		return false, errWebhookNotConfigured
+	}
+
+	res, err := db.Exec("update webhook_delivery set status = 'pending', attempts = 0, next_attempt = ? where id = ? and status != 'pending'", time.Now().Unix(), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	wakeWebhook(name)
+	return true, nil
+}
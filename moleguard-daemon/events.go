@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/4831c0/moleguard/common"
+)
+
+type nodeEvent struct {
+	Node   string `json:"node"`
+	Server string `json:"server"`
+	Reason string `json:"reason"`
+}
+
+// confMu serializes writing the device configs with wiping them on logout
+var confMu sync.Mutex
+
+// followEvents reads the controller's event stream until it ends or the context is canceled
+func followEvents(ctx context.Context, state common.State, current func() common.State) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/events", state.VpnHost), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", state.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data += strings.TrimPrefix(line, "data: ")
+		case line == "":
+			if data != "" {
+				handleEvent(ctx, current, event, data)
+			}
+			event, data = "", ""
+		}
+	}
+
+	return scanner.Err()
+}
+
+// handleEvent keeps the device configs in sync and logs what happens to the last used node
+func handleEvent(ctx context.Context, current func() common.State, event string, data string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("Failed to handle event %s: %s\n", event, err)
+		}
+	}()
+
+	var ev nodeEvent
+	_ = json.Unmarshal([]byte(data), &ev)
+
+	state := current()
+	switch event {
+	case "device.created", "device.deleted":
+		confMu.Lock()
+		defer confMu.Unlock()
+
+		// logged out in the meantime, the configs are wiped already
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Devices changed on %s, syncing configs\n", ev.Node)
+		if err := syncConf(state); err != nil {
+			log.Printf("Failed to sync configs: %s\n", err)
+		}
+	case "relay.changing", "relay.changed", "relay.failed":
+		if ev.Node == state.LastNode {
+			log.Printf("Relay of %s: %s %s\n", ev.Node, event, ev.Server)
+		}
+	case "node.unhealthy", "node.healthy":
+		if ev.Node == state.LastNode {
+			log.Printf("Node %s: %s %s\n", ev.Node, event, ev.Reason)
+		}
+	}
+}
+
+// watchEvents follows the controller's events for the login until the context is canceled
+func watchEvents(ctx context.Context, state common.State, current func() common.State) {
+	for {
+		if err := followEvents(ctx, state, current); err != nil && ctx.Err() == nil {
+			log.Printf("Event stream failed: %s\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// eventWatcher runs watchEvents for the current login, it is restarted when
+// the token or the controller changes and stopped on logout
+type eventWatcher struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	current func() common.State
+}
+
+func (w *eventWatcher) restart(state common.State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+	if state.Token == "" || state.VpnHost == "" {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	go watchEvents(ctx, state, w.current)
+}
+
+func (w *eventWatcher) stop() {
+	w.restart(common.State{})
+}
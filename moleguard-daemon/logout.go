@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/4831c0/moleguard/common"
+)
+
+// errUserToken is returned for the user token, the controller only rotates it
+var errUserToken = errors.New("the user token can't be revoked")
+
+// revokeToken revokes the daemon's token on the controller
+func revokeToken(state common.State) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/token/revoke", state.VpnHost), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", state.Token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		return errUserToken
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errors.New("the controller did not accept the token, it may be revoked already")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+
+	return nil
+}
+
+// downInterfaces brings the moleguard interfaces down, before their configs
+// are wiped. Errors are only logged, the wipe happens either way.
+func downInterfaces() {
+	wg, err := exec.LookPath("wg")
+	if err != nil {
+		log.Printf("Failed to find wg: %s\n", err)
+		return
+	}
+	wgQuick, err := exec.LookPath("wg-quick")
+	if err != nil {
+		log.Printf("Failed to find wg-quick: %s\n", err)
+		return
+	}
+
+	wgBytes, err := exec.Command(wg, "show", "interfaces").Output()
+	if err != nil {
+		log.Printf("Failed to list the interfaces: %s\n", err)
+		return
+	}
+
+	for _, intf := range strings.Fields(string(wgBytes)) {
+		if !strings.HasPrefix(intf, "wg-node-") {
+			continue
+		}
+
+		confPath := path.Join(common.MoleguardWgConfActive, intf+".conf")
+		log.Println("wg-quick down " + confPath)
+		if exists(confPath) {
+			err = exec.Command(wgQuick, "down", confPath).Run()
+		} else {
+			err = exec.Command("ip", "link", "delete", "dev", intf).Run()
+		}
+		if err != nil {
+			log.Printf("Failed to bring %s down: %s\n", intf, err)
+		}
+	}
+}
+
+// wipeDir removes everything in the directory but keeps the directory
+func wipeDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
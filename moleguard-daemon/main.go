@@ -15,6 +15,7 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -112,10 +113,113 @@ func initChisel(state common.State) {
 	check(os.WriteFile(common.MoleguardChisel, respBytes, 0600))
 }
 
+// syncConf fetches the device configs of the selected slots and writes them
+// to the raw and the active config directory
+func syncConf(state common.State) error {
+	for _, node := range state.NodeCache {
+		selectedId, ok := state.Slots[node]
+
+		if !ok {
+			return fmt.Errorf("no slot selected for node: %s", node)
+		}
+		confPath := path.Join(common.MoleguardWgConfDir, "wg-"+node+".conf")
+		confModPath := path.Join(common.MoleguardWgConfActive, "wg-"+node+".conf")
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/device", state.VpnHost, node), nil)
+		if err != nil {
+			if exists(confModPath) {
+				continue
+			} else {
+				panic(err)
+			}
+		}
+
+		req.Header.Set("Authorization", state.Token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if exists(confModPath) {
+				continue
+			} else {
+				panic(err)
+			}
+		}
+
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			if exists(confModPath) {
+				continue
+			} else {
+				panic(err)
+			}
+		}
+
+		resp.Body.Close()
+
+		var devices []common.Device
+		err = json.Unmarshal(respBytes, &devices)
+
+		var device *common.Device = nil
+
+		for _, d := range devices {
+			if d.Id == selectedId {
+				device = &d
+				break
+			}
+		}
+
+		if device == nil {
+			return fmt.Errorf("slot %d can't be found for node: %s", selectedId, node)
+		}
+
+		err = os.WriteFile(confPath, []byte(device.Config), 0600)
+		check(err)
+
+		confStr := device.Config
+
+		ipInt, err := common.IPv4ToUint32(state.IP)
+		check(err)
+
+		cidrPairs := common.BuildCIDRsExcept(ipInt)
+		cidrStr := common.JoinCIDRs(cidrPairs)
+
+		confStr = strings.ReplaceAll(confStr, "AllowedIPs = 0.0.0.0/0", "AllowedIPs = "+cidrStr)
+		confStr = strings.ReplaceAll(confStr, "109.122.216.14:", "127.0.0.1:")
+
+		err = os.WriteFile(confModPath, []byte(confStr), 0600)
+		check(err)
+	}
+
+	return nil
+}
+
 func main() {
+	// state is replaced by the handlers and read by the event watcher, stateMu guards it
 	var state common.State
+	var stateMu sync.Mutex
+
+	snapshot := func() common.State {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+
+		return state
+	}
+
+	// update changes the state and persists it
+	update := func(change func(*common.State)) common.State {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+
+		change(&state)
+
+		stateBytes, err := json.Marshal(&state)
+		check(err)
+
+		check(os.WriteFile(common.MoleguardState, stateBytes, 0600))
+		return state
+	}
 
 	http.DefaultTransport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		state := snapshot()
 		if addr == state.VpnHost+":443" {
 			return net.Dial(network, state.IP+":443")
 		}
@@ -166,6 +270,9 @@ func main() {
 		check(os.MkdirAll(common.MoleguardWgConfActive, 0700))
 	}
 
+	watcher := &eventWatcher{current: snapshot}
+	watcher.restart(snapshot())
+
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.Default()
 
@@ -208,10 +315,12 @@ func main() {
 	})
 
 	router.GET("/state", func(c *gin.Context) {
+		state := snapshot()
 		c.JSON(200, &state)
 	})
 
 	router.GET("/sync-conf", func(c *gin.Context) {
+		state := snapshot()
 		initChisel(state)
 
 		if !chiselActive.Load() {
@@ -219,85 +328,20 @@ func main() {
 			go runChisel()
 		}
 
-		for _, node := range state.NodeCache {
-			selectedId, ok := state.Slots[node]
-
-			if !ok {
-				c.String(500, fmt.Sprintf("no slot selected for node: %s", node))
-				return
-			}
-			confPath := path.Join(common.MoleguardWgConfDir, "wg-"+node+".conf")
-			confModPath := path.Join(common.MoleguardWgConfActive, "wg-"+node+".conf")
-			req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/%s/device", state.VpnHost, node), nil)
-			if err != nil {
-				if exists(confModPath) {
-					continue
-				} else {
-					panic(err)
-				}
-			}
-
-			req.Header.Set("Authorization", state.Token)
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				if exists(confModPath) {
-					continue
-				} else {
-					panic(err)
-				}
-			}
-
-			respBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				if exists(confModPath) {
-					continue
-				} else {
-					panic(err)
-				}
-			}
-
-			resp.Body.Close()
-
-			var devices []common.Device
-			err = json.Unmarshal(respBytes, &devices)
-
-			var device *common.Device = nil
-
-			for _, d := range devices {
-				if d.Id == selectedId {
-					device = &d
-					break
-				}
-			}
-
-			if device == nil {
-				c.String(500, fmt.Sprintf("slot %d can't be found for node: %s", selectedId, node))
-				return
-			}
-
-			err = os.WriteFile(confPath, []byte(device.Config), 0600)
-			check(err)
-
-			confStr := device.Config
+		confMu.Lock()
+		defer confMu.Unlock()
 
-			ipInt, err := common.IPv4ToUint32(state.IP)
-			check(err)
-
-			cidrPairs := common.BuildCIDRsExcept(ipInt)
-			cidrStr := common.JoinCIDRs(cidrPairs)
-
-			confStr = strings.ReplaceAll(confStr, "AllowedIPs = 0.0.0.0/0", "AllowedIPs = "+cidrStr)
-			confStr = strings.ReplaceAll(confStr, "109.122.216.14:", "127.0.0.1:")
-
-			err = os.WriteFile(confModPath, []byte(confStr), 0600)
-			check(err)
+		if err := syncConf(state); err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
 		c.String(200, "ok")
 	})
 
 	router.GET("/nodes", func(c *gin.Context) {
+		state := snapshot()
+
 		req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/nodes", state.VpnHost), nil)
 		if err != nil {
 			if len(state.NodeCache) != 0 {
@@ -354,12 +398,7 @@ func main() {
 		slices.Sort(nodes)
 
 		if len(state.NodeCache) != len(nodes) {
-			state.NodeCache = nodes
-
-			stateBytes, err := json.Marshal(&state)
-			check(err)
-
-			check(os.WriteFile(common.MoleguardState, stateBytes, 0600))
+			state = update(func(s *common.State) { s.NodeCache = nodes })
 			c.JSON(200, &state)
 		}
 
@@ -367,15 +406,60 @@ func main() {
 	})
 
 	router.POST("/state", func(c *gin.Context) {
-		check(c.BindJSON(&state))
-
-		stateBytes, err := json.Marshal(&state)
-		check(err)
+		// decoded on its own, the maps of the current state may be in use
+		var newState common.State
+		check(c.BindJSON(&newState))
+
+		var loginChanged bool
+		state := update(func(s *common.State) {
+			loginChanged = s.Token != newState.Token || s.VpnHost != newState.VpnHost
+			*s = newState
+		})
+
+		if loginChanged {
+			watcher.restart(state)
+		}
 
-		check(os.WriteFile(common.MoleguardState, stateBytes, 0600))
 		c.JSON(200, &state)
 	})
 
+	router.POST("/logout", func(c *gin.Context) {
+		var logout common.Logout
+
+		watcher.stop()
+
+		current := snapshot()
+		if current.Token != "" && current.VpnHost != "" {
+			err := revokeToken(current)
+			if errors.Is(err, errUserToken) {
+				logout.UserToken = true
+			} else if err != nil {
+				log.Printf("Failed to revoke the token: %s\n", err)
+				logout.Error = err.Error()
+			} else {
+				logout.Revoked = true
+			}
+		}
+
+		downInterfaces()
+
+		confMu.Lock()
+		defer confMu.Unlock()
+
+		check(wipeDir(common.MoleguardWgConfDir))
+		check(wipeDir(common.MoleguardWgConfActive))
+
+		stateMu.Lock()
+		state = common.State{}
+		if exists(common.MoleguardState) {
+			check(os.Remove(common.MoleguardState))
+		}
+		stateMu.Unlock()
+
+		log.Println("Logged out")
+		c.JSON(200, &logout)
+	})
+
 	listener, err := net.Listen("unix", common.MoleguardSock)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the node answers the peers' DNS queries on the wg0 address and forwards them
+// through the upstream tunnel, names on the blocklist get NXDOMAIN. Only
+// aggregate counters are kept, queries are never logged per client.
+
+type DnsConfig struct {
+	Listen   string
+	Upstream string
+	// BlocklistFile persists the blocklist pushed by the controller
+	BlocklistFile string
+}
+
+var dnsConfig = DnsConfig{
+	Listen:   "10.13.13.1:53",
+	Upstream: "10.64.0.1:53",
+}
+
+var blocklist = map[string]bool{}
+var blocklistUpdatedAt time.Time
+var blocklistMu sync.RWMutex
+
+type DnsStatus struct {
+	Listen             string            `json:"listen"`
+	Upstream           string            `json:"upstream"`
+	BlocklistEntries   int               `json:"blocklist_entries"`
+	BlocklistUpdatedAt *time.Time        `json:"blocklist_updated_at"`
+	Queries            map[string]uint64 `json:"queries"`
+}
+
+const dnsTimeout = 5 * time.Second
+
+// parseHosts reads a hosts format blocklist, plain lists of names are accepted too
+func parseHosts(r io.Reader) (map[string]bool, error) {
+	names := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// "0.0.0.0 ads.example.com tracker.example.com" or "ads.example.com"
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, name := range fields {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			if name == "" || name == "localhost" || net.ParseIP(name) != nil {
+				continue
+			}
+			names[name] = true
+		}
+	}
+
+	return names, scanner.Err()
+}
+
+func loadBlocklist() error {
+	f, err := os.Open(dnsConfig.BlocklistFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	names, err := parseHosts(f)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	blocklistMu.Lock()
+	blocklist = names
+	blocklistUpdatedAt = stat.ModTime()
+	blocklistMu.Unlock()
+
+	return nil
+}
+
+// setBlocklist replaces the blocklist and persists it
+func setBlocklist(hosts []byte) (int, error) {
+	names, err := parseHosts(strings.NewReader(string(hosts)))
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := dnsConfig.BlocklistFile + ".tmp"
+	if err := os.WriteFile(tmp, hosts, 0600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, dnsConfig.BlocklistFile); err != nil {
+		return 0, err
+	}
+
+	blocklistMu.Lock()
+	blocklist = names
+	blocklistUpdatedAt = time.Now()
+	blocklistMu.Unlock()
+
+	return len(names), nil
+}
+
+// blocked matches the name and each of its parent domains
+func blocked(name string) bool {
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for name != "" {
+		if blocklist[name] {
+			return true
+		}
+
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+
+	return false
+}
+
+func dnsStatus() DnsStatus {
+	blocklistMu.RLock()
+	status := DnsStatus{
+		Listen:             dnsConfig.Listen,
+		Upstream:           dnsConfig.Upstream,
+		BlocklistEntries:   len(blocklist),
+		BlocklistUpdatedAt: optionalTime(blocklistUpdatedAt),
+	}
+	blocklistMu.RUnlock()
+
+	metricsMu.Lock()
+	status.Queries = make(map[string]uint64, len(dnsQueries))
+	for result, n := range dnsQueries {
+		status.Queries[result] = n
+	}
+	metricsMu.Unlock()
+
+	return status
+}
+
+// questionName returns the name of the first question and the end of the question section
+func questionName(msg []byte) (string, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, errors.New("no question")
+	}
+
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return "", 0, errors.New("truncated question")
+		}
+
+		l := int(msg[i])
+		i++
+		if l == 0 {
+			break
+		}
+		// queries don't use compression
+		if l > 63 || i+l > len(msg) {
+			return "", 0, errors.New("invalid label")
+		}
+
+		labels = append(labels, string(msg[i:i+l]))
+		i += l
+	}
+
+	// qtype and qclass
+	if i+4 > len(msg) {
+		return "", 0, errors.New("truncated question")
+	}
+
+	return strings.Join(labels, "."), i + 4, nil
+}
+
+// refuse builds an answer with the given rcode that only repeats the question
+func refuse(msg []byte, questionEnd int, rcode byte) []byte {
+	resp := make([]byte, questionEnd)
+	copy(resp, msg[:questionEnd])
+
+	// QR, keep opcode and RD, RA, rcode
+	resp[2] = 0x80 | (msg[2] & 0x79)
+	resp[3] = 0x80 | rcode
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], 0)
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+
+	return resp
+}
+
+// dnsDialer reaches the upstream resolver the way the peer's traffic goes,
+// through its own exit when it has one and the active relay otherwise
+func dnsDialer(peer string) *net.Dialer {
+	if simulator != nil {
+		return &net.Dialer{Timeout: dnsTimeout}
+	}
+
+	// the exits have their own routing tables, the fwmark only leads to the active relay
+	if intf := exitInterface(peer); intf != "" {
+		return &net.Dialer{Timeout: dnsTimeout, Control: bindInterface(intf)}
+	}
+
+	relay, _ := currentRelay()
+	dialer := probeDialer(relay)
+	dialer.Timeout = dnsTimeout
+	dialer.Resolver = nil
+
+	return dialer
+}
+
+func forwardDns(network string, msg []byte, peer string) ([]byte, error) {
+	conn, err := dnsDialer(peer).Dial(network, dnsConfig.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "udp" {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if err := writeDnsTcp(conn, msg); err != nil {
+		return nil, err
+	}
+	return readDnsTcp(conn)
+}
+
+// resolve answers a query of the peer with the address
+func resolve(network string, msg []byte, peer string) []byte {
+	name, questionEnd, err := questionName(msg)
+	if err != nil {
+		observeDnsQuery("invalid")
+		return nil
+	}
+
+	if blocked(name) {
+		observeDnsQuery("blocked")
+		return refuse(msg, questionEnd, 3)
+	}
+
+	resp, err := forwardDns(network, msg, peer)
+	if err != nil {
+		observeDnsQuery("failed")
+		return refuse(msg, questionEnd, 2)
+	}
+
+	observeDnsQuery("forwarded")
+	return resp
+}
+
+// hostOf returns the address without the port
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func readDnsTcp(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+
+	return msg, err
+}
+
+func writeDnsTcp(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func serveDnsUdp(conn net.PacketConn) {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("DNS read failed: %s\n", err)
+			return
+		}
+
+		go func() {
+			if resp := resolve("udp", buf[:n], hostOf(addr)); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func serveDnsTcp(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("DNS accept failed: %s\n", err)
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+				msg, err := readDnsTcp(conn)
+				if err != nil {
+					return
+				}
+
+				resp := resolve("tcp", msg, hostOf(conn.RemoteAddr()))
+				if resp == nil || writeDnsTcp(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// startDns listens on udp and tcp, failing to listen does not stop the node
+func startDns() bool {
+	udp, err := net.ListenPacket("udp", dnsConfig.Listen)
+	if err != nil {
+		log.Printf("DNS resolver disabled: %s\n", err)
+		return false
+	}
+
+	tcp, err := net.Listen("tcp", dnsConfig.Listen)
+	if err != nil {
+		udp.Close()
+		log.Printf("DNS resolver disabled: %s\n", err)
+		return false
+	}
+
+	log.Printf("DNS resolver listening on %s, forwarding to %s\n", dnsConfig.Listen, dnsConfig.Upstream)
+
+	go serveDnsUdp(udp)
+	go serveDnsTcp(tcp)
+
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Executor runs the external commands of the node, wg-quick, iptables, wg
+// and friends, so they can be replaced in simulate mode
+type Executor interface {
+	// Run runs a command with its output going to the node's log
+	Run(name string, args ...string) error
+	// Output runs a command and returns what it wrote to stdout
+	Output(name string, args ...string) ([]byte, error)
+}
+
+type osExecutor struct{}
+
+func (osExecutor) Run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func (osExecutor) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+var executor Executor = osExecutor{}
+
+func run(c string, args ...string) error {
+	return executor.Run(c, args...)
+}
+
+func output(c string, args ...string) ([]byte, error) {
+	return executor.Output(c, args...)
+}
+
+// quiet runs a command whose failure is expected, e.g. taking down an interface that is not up
+func quiet(c string, args ...string) error {
+	_, err := executor.Output(c, args...)
+	return err
+}
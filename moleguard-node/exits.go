@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// peers can exit through another relay than the active one. Every relay chosen
+// by a peer is brought up as an additional exit with its own routing table,
+// the peer's traffic is routed there by its source address. Peers without a
+// choice follow the active relay through wg-quick's own rules.
+
+const exitTableBase = 1000
+
+// rule priorities, all of them come before the rules of wg-quick
+const localRulePriority = 900
+const exitRulePriority = 1000
+
+var exitDir = path.Join(os.TempDir(), "moleguard-exits")
+
+type Exit struct {
+	Relay     string `json:"relay"`
+	Interface string `json:"interface"`
+	Table     int    `json:"table"`
+}
+
+type PeerExit struct {
+	Peer string `json:"peer"`
+	// Relay is empty when the peer follows the active relay
+	Relay string `json:"relay"`
+}
+
+type ExitStatus struct {
+	// Peers maps a peer's address to its exit relay
+	Peers map[string]string `json:"peers"`
+	Exits []Exit            `json:"exits"`
+}
+
+// peerExits, exits and exitRules are guarded by wgMutex, changes to
+// peerExits also take peerExitsMu so the state can be saved at any time
+var peerExits = map[string]string{}
+var peerExitsMu sync.Mutex
+
+// exits are the additional exits that are up, by relay
+var exits = map[string]Exit{}
+
+// exitRules are the installed rules, the routing table by peer address
+var exitRules = map[string]int{}
+
+// exitRoutes mirrors exitRules as the interface by peer address and exitList
+// mirrors exits sorted by table, for readers like the DNS resolver and the
+// status endpoint that can't wait for wgMutex during a relay change
+var exitRoutes = map[string]string{}
+var exitList = []Exit{}
+var exitRoutesMu sync.RWMutex
+
+// updateExitRoutes refreshes exitRoutes and exitList, callers hold wgMutex
+func updateExitRoutes() {
+	routes := map[string]string{}
+	for peer, table := range exitRules {
+		for _, exit := range exits {
+			if exit.Table == table {
+				routes[peer] = exit.Interface
+			}
+		}
+	}
+
+	list := []Exit{}
+	for _, exit := range exits {
+		list = append(list, exit)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Table < list[j].Table })
+
+	exitRoutesMu.Lock()
+	exitRoutes = routes
+	exitList = list
+	exitRoutesMu.Unlock()
+}
+
+// exitInterface returns the additional exit the peer's traffic leaves
+// through, empty when it follows the active relay
+func exitInterface(peer string) string {
+	exitRoutesMu.RLock()
+	defer exitRoutesMu.RUnlock()
+
+	return exitRoutes[peer]
+}
+
+// upExit brings up a relay's config as an additional exit. The config keeps
+// its FwMark, so the tunnel's own packets are routed past the active relay,
+// and the DNS is dropped as it belongs to the active relay.
+func upExit(confPath string, intf string, table int) error {
+	confBytes, err := os.ReadFile(confPath)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(confBytes), "\n") {
+		if strings.HasPrefix(line, "DNS") || strings.HasPrefix(line, "Table") {
+			continue
+		}
+
+		lines = append(lines, line)
+		if strings.TrimSpace(line) == "[Interface]" {
+			lines = append(lines, fmt.Sprintf("Table = %d", table))
+		}
+	}
+
+	conf := strings.Join(lines, "\n")
+	if !strings.Contains(conf, "FwMark") {
+		conf = strings.Replace(conf, "[Interface]", fmt.Sprintf("[Interface]\nFwMark = %d", fwMark), 1)
+	}
+
+	err = os.MkdirAll(exitDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	exitPath := path.Join(exitDir, intf+".conf")
+	err = os.WriteFile(exitPath, []byte(conf), 0600)
+	if err != nil {
+		return err
+	}
+
+	return run(wgQuick, "up", exitPath)
+}
+
+func downExit(exit Exit) error {
+	return run(wgQuick, "down", path.Join(exitDir, exit.Interface+".conf"))
+}
+
+// removeExitRules deletes every rule at the priorities of exitsInit and syncExits
+func removeExitRules() {
+	for _, priority := range []int{localRulePriority, exitRulePriority} {
+		for quiet(ipCmd, "rule", "del", "priority", strconv.Itoa(priority)) == nil {
+		}
+	}
+}
+
+// exitsInit replaces the routing rules left behind by a previous run, traffic
+// to the peers and marked replies of port forwards always use the main table.
+// Running it again leaves a single set of rules.
+func exitsInit() error {
+	removeExitRules()
+
+	if err := run(ipCmd, "rule", "add", "to", "10.13.13.0/24", "lookup", "main", "priority", strconv.Itoa(localRulePriority)); err != nil {
+		return err
+	}
+
+	return run(ipCmd, "rule", "add", "fwmark", strconv.Itoa(fwMark), "lookup", "main", "priority", strconv.Itoa(localRulePriority))
+}
+
+func validatePeerExit(peer string, relay string) error {
+	ip := net.ParseIP(peer)
+	_, subnet, _ := net.ParseCIDR("10.13.13.0/24")
+	if ip == nil || !subnet.Contains(ip) {
+		return fmt.Errorf("invalid peer address: %s", peer)
+	}
+
+	if relay == "" {
+		return nil
+	}
+
+	if _, ok := provider.(exitProvider); !ok {
+		return errors.New("the upstream provider does not support per-peer exits")
+	}
+	if _, ok := lookupRelay(relay); !ok {
+		return fmt.Errorf("unknown relay: %s", relay)
+	}
+
+	return nil
+}
+
+func freeExitTable() int {
+	used := map[int]bool{}
+	for _, exit := range exits {
+		used[exit.Table] = true
+	}
+
+	table := exitTableBase + 1
+	for used[table] {
+		table++
+	}
+
+	return table
+}
+
+// syncExits brings up the exits chosen by the peers, takes down the unused
+// ones and points the peers' rules at them. A peer whose relay is the active
+// one follows the active relay. It reports whether the set of exits changed,
+// the firewall rules need to be set up again then. Callers hold wgMutex.
+func syncExits() (bool, error) {
+	var firstErr error
+	fail := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	active, _ := currentRelay()
+	wanted := map[string]bool{}
+	for _, relay := range peerExits {
+		if relay != active {
+			wanted[relay] = true
+		}
+	}
+
+	// rules first, so no peer is routed into an exit that goes away
+	for peer, table := range exitRules {
+		relay, ok := peerExits[peer]
+		if ok && wanted[relay] && exits[relay].Table == table {
+			continue
+		}
+
+		fail(run(ipCmd, "rule", "del", "from", peer, "lookup", strconv.Itoa(table), "priority", strconv.Itoa(exitRulePriority)))
+		delete(exitRules, peer)
+	}
+
+	changed := false
+	for relay, exit := range exits {
+		if wanted[relay] {
+			continue
+		}
+
+		log.Printf("Disabling exit %s on %s\n", relay, exit.Interface)
+		fail(downExit(exit))
+		delete(exits, relay)
+		changed = true
+	}
+
+	if ep, ok := provider.(exitProvider); ok {
+		for relay := range wanted {
+			if _, ok := exits[relay]; ok {
+				continue
+			}
+
+			table := freeExitTable()
+			exit := Exit{Relay: relay, Interface: fmt.Sprintf("mgx%d", table), Table: table}
+
+			log.Printf("Enabling exit %s on %s\n", relay, exit.Interface)
+			if err := ep.UpExit(relay, exit.Interface, exit.Table); err != nil {
+				fail(err)
+				continue
+			}
+			exits[relay] = exit
+			changed = true
+		}
+	}
+
+	for peer, relay := range peerExits {
+		exit, ok := exits[relay]
+		if !ok || exitRules[peer] == exit.Table {
+			continue
+		}
+
+		err := run(ipCmd, "rule", "add", "from", peer, "lookup", strconv.Itoa(exit.Table), "priority", strconv.Itoa(exitRulePriority))
+		if err != nil {
+			fail(err)
+			continue
+		}
+		exitRules[peer] = exit.Table
+	}
+
+	updateExitRoutes()
+	return changed, firstErr
+}
+
+// setPeerExit changes the exit of a peer, an empty relay makes it follow the active relay
+func setPeerExit(peer string, relay string) error {
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+
+	peerExitsMu.Lock()
+	if relay == "" {
+		delete(peerExits, peer)
+	} else {
+		peerExits[peer] = relay
+	}
+	peerExitsMu.Unlock()
+
+	changed, err := syncExits()
+	if changed {
+		if err := iptablesTeardown(); err != nil {
+			observeFirewallError("teardown")
+		}
+		relay, _ := currentRelay()
+		if err := iptablesSetup(relay); err != nil {
+			observeFirewallError("setup")
+			return err
+		}
+	}
+
+	saveState()
+	return err
+}
+
+// downExits takes every additional exit down and removes the routing rules
+// and tables of the exits, callers hold wgMutex
+func downExits() {
+	for relay, exit := range exits {
+		if err := downExit(exit); err != nil {
+			log.Printf("Failed to disable exit %s: %s\n", relay, err)
+		}
+		// routes a failed wg-quick down left behind, an empty table is fine
+		_ = quiet(ipCmd, "route", "flush", "table", strconv.Itoa(exit.Table))
+		delete(exits, relay)
+	}
+
+	removeExitRules()
+	clear(exitRules)
+	updateExitRoutes()
+}
+
+func getPeerExits() map[string]string {
+	peerExitsMu.Lock()
+	defer peerExitsMu.Unlock()
+
+	peers := make(map[string]string, len(peerExits))
+	for peer, relay := range peerExits {
+		peers[peer] = relay
+	}
+
+	return peers
+}
+
+// exitStatus doesn't take wgMutex, the exits are read from the last snapshot
+func exitStatus() ExitStatus {
+	exitRoutesMu.RLock()
+	list := exitList
+	exitRoutesMu.RUnlock()
+
+	return ExitStatus{Peers: getPeerExits(), Exits: list}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// the node's rules live in their own chains, so they can be flushed and
+// reconciled without touching the rules of the wireguard image
+const fwdChain = "MOLEGUARD-FWD"
+const natChain = "MOLEGUARD-NAT"
+
+var ipCmd = "/sbin/ip"
+
+type chainJump struct {
+	table  string
+	chain  string
+	parent string
+}
+
+// the port forwarding chain comes first, fwdChain rejects everything it doesn't accept
+var chainJumps = []chainJump{
+	{"filter", pfChain, "FORWARD"},
+	{"filter", fwdChain, "FORWARD"},
+	{"nat", natChain, "POSTROUTING"},
+	{"nat", pfNatChain, "PREROUTING"},
+	{"mangle", pfMarkChain, "PREROUTING"},
+}
+
+// firewallInit creates the chains and makes sure each is jumped to exactly
+// once, rules left behind by an unclean exit are flushed
+func firewallInit() error {
+	for _, c := range chainJumps {
+		// fails when the chain survived a previous run
+		_ = quiet(iptables, "-t", c.table, "-N", c.chain)
+
+		if err := run(iptables, "-t", c.table, "-F", c.chain); err != nil {
+			return err
+		}
+		for quiet(iptables, "-t", c.table, "-D", c.parent, "-j", c.chain) == nil {
+		}
+		if err := run(iptables, "-t", c.table, "-A", c.parent, "-j", c.chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func firewallRemove() error {
+	for _, c := range chainJumps {
+		for quiet(iptables, "-t", c.table, "-D", c.parent, "-j", c.chain) == nil {
+		}
+		if err := run(iptables, "-t", c.table, "-F", c.chain); err != nil {
+			return err
+		}
+		if err := run(iptables, "-t", c.table, "-X", c.chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func iptablesSetup(newRelay string) error {
+	// Forwarding
+	if err := run(iptables, "-A", fwdChain, "-o", publicInterface, "!", "-d", "10.13.13.1/24", "-j", "REJECT"); err != nil {
+		return err
+	}
+	if err := run(iptables, "-A", fwdChain, "-i", newRelay, "-j", "ACCEPT"); err != nil {
+		return err
+	}
+	for _, exit := range exits {
+		if err := run(iptables, "-A", fwdChain, "-i", exit.Interface, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+	if err := run(iptables, "-A", fwdChain, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
+		return err
+	}
+	if err := run(iptables, "-A", fwdChain, "-j", "REJECT"); err != nil {
+		return err
+	}
+
+	// NAT
+
+	if err := run(iptables, "-t", "nat", "-A", natChain, "-o", publicInterface, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+	if err := run(iptables, "-t", "nat", "-A", natChain, "-o", newRelay, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
+	for _, exit := range exits {
+		if err := run(iptables, "-t", "nat", "-A", natChain, "-o", exit.Interface, "-j", "MASQUERADE"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func iptablesTeardown() error {
+	if err := run(iptables, "-F", fwdChain); err != nil {
+		return err
+	}
+
+	return run(iptables, "-t", "nat", "-F", natChain)
+}
+
+// removeStaleInterfaces deletes upstream wireguard interfaces that are still
+// around after provider.Down, e.g. because their config was removed
+func removeStaleInterfaces() {
+	out, err := output(wg, "show", "interfaces")
+	if err != nil {
+		return
+	}
+
+	for _, intf := range strings.Fields(string(out)) {
+		if intf == "wg0" {
+			continue
+		}
+
+		log.Printf("Removing stale interface: %s\n", intf)
+		_ = run(ipCmd, "link", "del", intf)
+	}
+}
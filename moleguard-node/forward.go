@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// inbound connections on the public interface are forwarded to peers. The
+// connections are marked so the replies leave through the public interface
+// instead of the upstream tunnel, wg-quick routes fwMark past the tunnel.
+const pfChain = "MOLEGUARD-PF"
+const pfNatChain = "MOLEGUARD-PF-NAT"
+const pfMarkChain = "MOLEGUARD-PF-MARK"
+
+var publicInterface = "eth0"
+
+type PortForward struct {
+	PublicPort int    `json:"public_port"`
+	Protocol   string `json:"protocol"`
+	TargetIp   string `json:"target_ip"`
+	TargetPort int    `json:"target_port"`
+}
+
+var forwards []PortForward
+var forwardsMu sync.Mutex
+
+// ports the node itself listens on can't be forwarded
+var reservedPorts = map[string][]int{
+	"tcp": {8888},
+	"udp": {51820},
+}
+
+func (f PortForward) validate() error {
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return fmt.Errorf("invalid protocol: %s", f.Protocol)
+	}
+	if f.PublicPort < 1 || f.PublicPort > 65535 || f.TargetPort < 1 || f.TargetPort > 65535 {
+		return fmt.Errorf("invalid port")
+	}
+	for _, port := range reservedPorts[f.Protocol] {
+		if f.PublicPort == port {
+			return fmt.Errorf("port %d/%s is reserved", port, f.Protocol)
+		}
+	}
+	if ip := net.ParseIP(f.TargetIp); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid target ip: %s", f.TargetIp)
+	}
+
+	return nil
+}
+
+func validateForwards(fs []PortForward) error {
+	seen := map[string]bool{}
+	for _, f := range fs {
+		if err := f.validate(); err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("%d/%s", f.PublicPort, f.Protocol)
+		if seen[key] {
+			return fmt.Errorf("port %s is forwarded twice", key)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+func forwardRules(fs []PortForward) error {
+	mark := strconv.Itoa(fwMark)
+
+	if len(fs) != 0 {
+		// replies from the peers are routed by the restored mark
+		if err := run(iptables, "-t", "mangle", "-A", pfMarkChain, "-i", "wg0", "-m", "connmark", "--mark", mark, "-j", "CONNMARK", "--restore-mark"); err != nil {
+			return err
+		}
+		if err := run(iptables, "-A", pfChain, "-m", "connmark", "--mark", mark, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range fs {
+		port := strconv.Itoa(f.PublicPort)
+		target := net.JoinHostPort(f.TargetIp, strconv.Itoa(f.TargetPort))
+
+		if err := run(iptables, "-t", "mangle", "-A", pfMarkChain, "-i", publicInterface, "-p", f.Protocol, "--dport", port, "-j", "CONNMARK", "--set-mark", mark); err != nil {
+			return err
+		}
+		if err := run(iptables, "-t", "nat", "-A", pfNatChain, "-i", publicInterface, "-p", f.Protocol, "--dport", port, "-j", "DNAT", "--to-destination", target); err != nil {
+			return err
+		}
+		if err := run(iptables, "-A", pfChain, "-i", publicInterface, "-o", "wg0", "-p", f.Protocol, "-d", f.TargetIp, "--dport", strconv.Itoa(f.TargetPort), "-m", "connmark", "--mark", mark, "-j", "ACCEPT"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyForwards replaces the port forwarding rules
+func applyForwards(fs []PortForward) error {
+	if err := run(iptables, "-F", pfChain); err != nil {
+		return err
+	}
+	if err := run(iptables, "-t", "nat", "-F", pfNatChain); err != nil {
+		return err
+	}
+	if err := run(iptables, "-t", "mangle", "-F", pfMarkChain); err != nil {
+		return err
+	}
+
+	return forwardRules(fs)
+}
+
+// setForwards replaces the forwards with the set pushed by the controller and persists them
+func setForwards(fs []PortForward) error {
+	forwardsMu.Lock()
+	err := applyForwards(fs)
+	if err == nil {
+		forwards = fs
+	} else {
+		observeFirewallError("forward")
+
+		// the previous rules stay in place as far as possible
+		if err := applyForwards(forwards); err != nil {
+			observeFirewallError("forward")
+		}
+	}
+	forwardsMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	saveState()
+	return nil
+}
+
+func getForwards() []PortForward {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	return append([]PortForward{}, forwards...)
+}
@@ -1,24 +1,32 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var wgQuick = "/usr/bin/wg-quick"
 var iptables = "/usr/sbin/iptables"
+var wg = "/usr/bin/wg"
 var mullvadUpgradeTunnel string
 
+// peerConfDir holds the peer configs generated by the wireguard image
+var peerConfDir = "/config"
+
 func init() {
 	wd, err := os.Getwd()
 	check(err)
@@ -34,55 +42,233 @@ func check(err error) {
 
 type Relay struct {
 	Server string `json:"server"`
+	Entry  string `json:"entry,omitempty"`
+	// Reason is recorded in the relay history
+	Reason string `json:"reason,omitempty"`
 }
 
-func run(c string, args ...string) error {
-	cmd := exec.Command(c, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	return cmd.Run()
+type RelayStatus struct {
+	Server string `json:"server"`
+	Entry  string `json:"entry,omitempty"`
+	// Pq is true once the tunnel went through the post-quantum upgrade
+	Pq bool `json:"pq"`
+	// Daita is true when the exit relay is DAITA capable
+	Daita bool `json:"daita"`
 }
 
-func netCheck() bool {
-	conn, err := net.Dial("tcp", "1.1.1.1:443")
-	if err == nil {
-		conn.Close()
-		return true
+func main() {
+	simulate := flag.Bool("simulate", false, "fake wg-quick, iptables and mullvad-upgrade-tunnel and record the commands instead of running them")
+	flag.Parse()
+
+	token := os.Getenv("TOKEN")
+	metricsToken := os.Getenv("METRICS_TOKEN")
+	metricsListen := os.Getenv("METRICS_LISTEN")
+	defaultRelay := os.Getenv("DEFAULT_RELAY")
+	upstream := os.Getenv("UPSTREAM")
+	if upstream == "" {
+		upstream = "mullvad"
+	}
+	confDir := os.Getenv("UPSTREAM_CONF_DIR")
+	if confDir == "" {
+		confDir = path.Join(os.Getenv("HOME"), ".config", "mullvad", "wg0")
+	}
+	stateFile = os.Getenv("STATE_FILE")
+	if stateFile == "" {
+		stateFile = path.Join(os.Getenv("HOME"), ".config", "mullvad", "moleguard-node.json")
 	}
 
-	conn, err = net.Dial("tcp", "google.com:443")
-	if err == nil {
-		conn.Close()
-		return true
+	var err error
+	provider, err = newProvider(upstream, confDir)
+	check(err)
+
+	if api := os.Getenv("MULLVAD_API"); api != "" {
+		mullvadApi = strings.TrimSuffix(api, "/")
 	}
 
-	conn, err = net.Dial("tcp", "github.com:443")
-	if err == nil {
-		conn.Close()
-		return true
+	relayFilter = RelayFilter{
+		Countries: splitList(os.Getenv("RELAY_COUNTRY")),
+		Cities:    splitList(os.Getenv("RELAY_CITY")),
+		Owned:     os.Getenv("RELAY_OWNED") == "true",
+		Daita:     os.Getenv("RELAY_DAITA") == "true",
+	}
+	if port := os.Getenv("RELAY_PROBE_PORT"); port != "" {
+		relayProbePort, err = strconv.Atoi(port)
+		check(err)
 	}
 
-	conn, err = net.Dial("tcp", "cloudflare.com:443")
-	if err == nil {
-		conn.Close()
-		return true
+	if targets := splitList(os.Getenv("PROBE_TARGETS")); len(targets) != 0 {
+		probeConfig.Targets = targets
+	}
+	if timeout := os.Getenv("PROBE_TIMEOUT"); timeout != "" {
+		probeConfig.Timeout, err = time.ParseDuration(timeout)
+		check(err)
+	}
+	if bind := os.Getenv("PROBE_BIND"); bind != "" {
+		if bind != "interface" && bind != "fwmark" && bind != "none" {
+			check(fmt.Errorf("invalid PROBE_BIND: %s", bind))
+		}
+		probeConfig.Bind = bind
+	}
+	if mark := os.Getenv("PROBE_MARK"); mark != "" {
+		probeConfig.Mark, err = strconv.Atoi(mark)
+		check(err)
+	}
+	if probeConfig.Bind == "fwmark" && probeConfig.Mark == 0 {
+		check(errors.New("PROBE_BIND=fwmark needs a non-zero PROBE_MARK"))
+	}
+	probeConfig.ExitCheck = os.Getenv("PROBE_EXIT_CHECK") == "true"
+	if exitUrl := os.Getenv("PROBE_EXIT_URL"); exitUrl != "" {
+		probeConfig.ExitUrl = exitUrl
 	}
 
-	return false
-}
+	if intf := os.Getenv("PUBLIC_INTERFACE"); intf != "" {
+		publicInterface = intf
+	}
 
-func main() {
-	token := os.Getenv("TOKEN")
-	defaultRelay := os.Getenv("DEFAULT_RELAY")
-	confDir := path.Join(os.Getenv("HOME"), ".config", "mullvad", "wg0")
+	if listen := os.Getenv("DNS_LISTEN"); listen != "" {
+		dnsConfig.Listen = listen
+	}
+	if upstream := os.Getenv("DNS_UPSTREAM"); upstream != "" {
+		dnsConfig.Upstream = upstream
+	}
 
-	activeRelay = defaultRelay
+	if *simulate {
+		// everything the simulation writes stays out of the real config directories
+		simDir := os.Getenv("SIMULATE_DIR")
+		if simDir == "" {
+			simDir = path.Join(os.TempDir(), "moleguard-simulate")
+		}
+		if os.Getenv("UPSTREAM_CONF_DIR") == "" {
+			confDir = path.Join(simDir, "wg0")
+			provider, err = newProvider(upstream, confDir)
+			check(err)
+		}
+		if os.Getenv("STATE_FILE") == "" {
+			stateFile = path.Join(simDir, "moleguard-node.json")
+		}
+		peerConfDir = path.Join(simDir, "config")
+
+		peerCount := 128
+		if peers := os.Getenv("PEERS"); peers != "" {
+			peerCount, err = strconv.Atoi(peers)
+			check(err)
+		}
 
-	check(downAll(confDir))
-	check(run(wgQuick, "up", path.Join(confDir, activeRelay+".conf")))
-	check(run(mullvadUpgradeTunnel, "-wg-interface", activeRelay))
-	check(iptablesSetup(activeRelay))
+		peers, err := simulateSetup(peerConfDir, peerCount, upstream, confDir, defaultRelay)
+		check(err)
+
+		simulator = newSimExecutor(peers)
+		executor = simulator
+		log.Printf("Simulating, files are kept in %s\n", simDir)
+	} else if account := os.Getenv("MULLVAD_ACCOUNT_NUMBER"); upstream == "mullvad" && account != "" {
+		err = provisionMullvad(account, confDir)
+		if err != nil {
+			if relays, _ := os.ReadDir(confDir); len(relays) == 0 {
+				check(err)
+			}
+			log.Printf("Provisioning failed, using existing configs: %s\n", err)
+		}
+
+		if interval := os.Getenv("MULLVAD_KEY_ROTATION"); interval != "" {
+			d, err := time.ParseDuration(interval)
+			check(err)
+
+			go keyRotationLoop(account, confDir, d)
+		}
+	}
+
+	saved, err := loadState()
+	check(err)
+
+	dnsConfig.BlocklistFile = os.Getenv("DNS_BLOCKLIST_FILE")
+	if dnsConfig.BlocklistFile == "" {
+		dnsConfig.BlocklistFile = path.Join(path.Dir(stateFile), "moleguard-blocklist.hosts")
+	}
+	check(loadBlocklist())
+
+	history = saved.History
+	rotation = saved.Rotation
+	rotation.Scheduler = "controller"
+	if os.Getenv("ROTATION_SCHEDULER") == "node" {
+		rotation.Scheduler = "node"
+	}
+
+	settings = NodeSettings{
+		PqUpgrade:   os.Getenv("PQ_UPGRADE") != "false",
+		PreferDaita: os.Getenv("PREFER_DAITA") == "true",
+	}
+	if saved.Settings != nil {
+		settings = *saved.Settings
+	}
+
+	// reconcile whatever an unclean exit left behind
+	check(provider.Down())
+	removeStaleInterfaces()
+	if err := firewallInit(); err != nil {
+		observeFirewallError("init")
+		check(err)
+	}
+	check(exitsInit())
+	if saved.PeerExits != nil {
+		peerExits = saved.PeerExits
+	}
+
+	fallbackRelay := defaultRelay
+	if os.Getenv("AUTO_RELAY") == "true" {
+		ranking, err := rankRelays()
+		if ranking != nil {
+			storeRanking(ranking)
+		}
+
+		if err != nil {
+			log.Printf("Automatic relay selection failed, using %s: %s\n", defaultRelay, err)
+		} else {
+			log.Printf("Selected %s: %s\n", ranking.Chosen, ranking.Reason)
+			fallbackRelay = ranking.Chosen
+		}
+
+		if interval := os.Getenv("AUTO_RELAY_INTERVAL"); interval != "" {
+			d, err := time.ParseDuration(interval)
+			check(err)
+
+			go autoRelayLoop(d)
+		}
+	}
+
+	setActiveRelay(fallbackRelay, "")
+	restored := false
+	if saved.ActiveRelay != "" {
+		log.Printf("Restoring saved relay: %s\n", saved.ActiveRelay)
+
+		setActiveRelay(saved.ActiveRelay, saved.ActiveEntry)
+		restored = restoreRelay()
+		if restored {
+			log.Println("Saved relay is healthy")
+		} else {
+			log.Printf("Saved relay failed its health check, falling back to %s\n", fallbackRelay)
+			check(provider.Down())
+
+			setActiveRelay(fallbackRelay, "")
+			recordSwitch(saved.ActiveRelay, fallbackRelay, "", "restore failed", nil)
+		}
+	}
+
+	if !restored {
+		check(provider.Up(fallbackRelay))
+		startPostUp(fallbackRelay)
+	}
+	if _, err := syncExits(); err != nil {
+		log.Printf("Failed to restore exits: %s\n", err)
+	}
+	relay, _ := currentRelay()
+	if err := iptablesSetup(relay); err != nil {
+		observeFirewallError("setup")
+		check(err)
+	}
+	if err := setForwards(saved.Forwards); err != nil {
+		log.Printf("Failed to restore port forwards: %s\n", err)
+	}
+	saveState()
 
 	go func() {
 		for {
@@ -90,20 +276,38 @@ func main() {
 
 			if !netCheck() {
 				log.Println("Failed to reach internet")
-				log.Println("Reconnecting to mullvad")
-				check(mullvadChange(activeRelay, confDir))
+				log.Println("Reconnecting upstream")
+				relay, entry := currentRelay()
+				if err := relayChange(relay, entry, "reconnect"); err != nil {
+					log.Printf("Failed to reconnect, retrying: %s\n", err)
+					continue
+				}
 				time.Sleep(10 * time.Second)
 			}
 		}
 	}()
 
+	if rotation.Scheduler == "node" {
+		go rotationLoop()
+	}
+
+	if dnsConfig.Listen != "off" && !startDns() {
+		dnsConfig.Listen = "off"
+	}
+
 	http.HandleFunc("GET /relay", func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Authorization") != token {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		jsonBytes, err := json.Marshal(Relay{Server: activeRelay})
+		relay, entry := currentRelay()
+		status := RelayStatus{Server: relay, Entry: entry, Pq: pqUpgraded.Load()}
+		if info, ok := lookupRelay(relay); ok {
+			status.Daita = info.Daita
+		}
+
+		jsonBytes, err := json.Marshal(&status)
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
@@ -122,17 +326,373 @@ func main() {
 		var relay Relay
 		check(json.Unmarshal(body, &relay))
 
-		log.Printf("Switching to: %s\n", activeRelay)
-		check(mullvadChange(relay.Server, confDir))
+		if relay.Entry != "" {
+			if err := validateMultihop(relay.Server, relay.Entry); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		manualChange.Add(1)
+		defer manualChange.Add(-1)
+
+		log.Printf("Switching to: %s\n", relay.Server)
+		reason := "manual"
+		if relay.Reason != "" {
+			reason += ": " + relay.Reason
+		}
+		check(relayChange(relay.Server, relay.Entry, reason))
 		log.Println("Done")
 
-		jsonBytes, err := json.Marshal(Relay{Server: relay.Server})
+		jsonBytes, err := json.Marshal(Relay{Server: relay.Server, Entry: relay.Entry})
 		check(err)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(jsonBytes)
 	})
 
+	http.HandleFunc("GET /relay/ranking", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Query().Get("refresh") == "true" {
+			ranking, err := rankRelays()
+			if ranking == nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+
+			storeRanking(ranking)
+		}
+
+		rankingMu.Lock()
+		jsonBytes, err := json.Marshal(lastRanking)
+		rankingMu.Unlock()
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /relay/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		stateMu.Lock()
+		jsonBytes, err := json.Marshal(&history)
+		stateMu.Unlock()
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /rotation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		rotationMu.Lock()
+		jsonBytes, err := json.Marshal(&rotation)
+		rotationMu.Unlock()
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /rotation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		check(err)
+
+		var policy RotationPolicy
+		err = json.Unmarshal(body, &policy)
+		if err == nil {
+			err = policy.validate()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		setRotationPolicy(policy)
+		log.Printf("Rotation policy updated: %+v\n", policy)
+
+		rotationMu.Lock()
+		jsonBytes, err := json.Marshal(&rotation)
+		rotationMu.Unlock()
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /rotation/rotate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		rotationMu.Lock()
+		enabled := rotation.Policy.Enabled
+		rotationMu.Unlock()
+
+		if !enabled {
+			http.Error(w, "rotation is disabled", http.StatusConflict)
+			return
+		}
+		if rotation.Scheduler == "node" {
+			http.Error(w, "rotations are scheduled by the node", http.StatusConflict)
+			return
+		}
+		if manualChange.Load() != 0 {
+			http.Error(w, "a relay change is in progress", http.StatusConflict)
+			return
+		}
+
+		relay, entry, err := rotate("rotation")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(Relay{Server: relay, Entry: entry})
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /settings", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(getSettings())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /settings", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		check(err)
+
+		s := getSettings()
+		err = json.Unmarshal(body, &s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		setSettings(s)
+		log.Printf("Settings updated: %+v\n", s)
+
+		jsonBytes, err := json.Marshal(&s)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(nodeStatus())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /exits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(exitStatus())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /peer/exit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		check(err)
+
+		var peerExit PeerExit
+		err = json.Unmarshal(body, &peerExit)
+		if err == nil {
+			err = validatePeerExit(peerExit.Peer, peerExit.Relay)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := setPeerExit(peerExit.Peer, peerExit.Relay); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Exit of %s set to %q\n", peerExit.Peer, peerExit.Relay)
+
+		jsonBytes, err := json.Marshal(&peerExit)
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /forwards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(getForwards())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /forwards", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		check(err)
+
+		var fs []PortForward
+		err = json.Unmarshal(body, &fs)
+		if err == nil {
+			err = validateForwards(fs)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := setForwards(fs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Port forwards updated: %d rules\n", len(fs))
+
+		jsonBytes, err := json.Marshal(getForwards())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /dns", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		jsonBytes, err := json.Marshal(dnsStatus())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("POST /dns/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		check(err)
+
+		entries, err := setBlocklist(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("DNS blocklist updated: %d entries\n", entries)
+
+		jsonBytes, err := json.Marshal(dnsStatus())
+		check(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	})
+
+	http.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	})
+
+	http.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ok, reason := ready()
+
+		w.Header().Set("Content-Type", "text/plain")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte(reason))
+	})
+
+	metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if metricsToken != "" && auth != metricsToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if metricsToken == "" && metricsListen == "" && auth != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	}
+
+	if metricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", metricsHandler)
+
+		go func() {
+			log.Printf("Metrics listening on %s\n", metricsListen)
+			log.Fatal(http.ListenAndServe(metricsListen, metricsMux))
+		}()
+	} else {
+		http.HandleFunc("GET /metrics", metricsHandler)
+	}
+
 	http.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Authorization") != token {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -143,7 +703,7 @@ func main() {
 		i, err := strconv.Atoi(q.Get("id"))
 		check(err)
 
-		confBytes, err := os.ReadFile(fmt.Sprintf("/config/peer%d/peer%d.conf", i, i))
+		confBytes, err := os.ReadFile(path.Join(peerConfDir, fmt.Sprintf("peer%d", i), fmt.Sprintf("peer%d.conf", i)))
 		check(err)
 
 		confLines := strings.Split(string(confBytes), "\n")
@@ -153,6 +713,12 @@ func main() {
 			if strings.HasPrefix(line, "ListenPort = ") {
 				continue
 			}
+			// peers resolve through the node's resolver
+			if strings.HasPrefix(line, "DNS = ") && dnsConfig.Listen != "off" {
+				host, _, err := net.SplitHostPort(dnsConfig.Listen)
+				check(err)
+				line = "DNS = " + host
+			}
 
 			confB.WriteString(line)
 			confB.WriteRune('\n')
@@ -168,13 +734,83 @@ func main() {
 			return
 		}
 
-		pubKey, err := os.ReadFile("/config/server/publickey-server")
+		pubKey, err := os.ReadFile(path.Join(peerConfDir, "server", "publickey-server"))
 		check(err)
 
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write(pubKey)
 	})
 
-	log.Println("Listening on http://localhost:8888")
-	log.Fatal(http.ListenAndServe(":8888", nil))
+	if simulator != nil {
+		http.HandleFunc("GET /simulate/commands", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			since := 0
+			if s := r.URL.Query().Get("since"); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				since = n
+			}
+
+			jsonBytes, err := json.Marshal(simulator.Commands(since))
+			check(err)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonBytes)
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":8888"}
+	go func() {
+		log.Println("Listening on http://localhost:8888")
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(server)
+}
+
+// shutdown waits for in-flight requests and relay changes, then tears down the
+// firewall rules and the upstream tunnel and persists the state
+func shutdown(server *http.Server) {
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to drain requests: %s\n", err)
+	}
+
+	// relay changes from the background loops hold the lock, once it is taken none are running
+	wgMutex.Lock()
+	defer wgMutex.Unlock()
+
+	saveState()
+
+	log.Println("Removing iptables rules")
+	if err := firewallRemove(); err != nil {
+		log.Printf("Failed to remove iptables rules: %s\n", err)
+	}
+
+	log.Println("Disabling upstream tunnels")
+	downExits()
+	if err := provider.Down(); err != nil {
+		log.Printf("Failed to disable upstream tunnels: %s\n", err)
+	}
+
+	log.Println("Done")
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exposed in the prometheus text format
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+var metricsMu sync.Mutex
+
+var relaySwitches = map[string]uint64{}
+var relaySwitchDuration = map[string]*histogram{}
+var probes = map[string]uint64{}
+var probeDuration = newHistogram(0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+var firewallErrors = map[string]uint64{}
+var dnsQueries = map[string]uint64{}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func observeRelaySwitch(d time.Duration, err error) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	o := outcome(err)
+	relaySwitches[o]++
+	if relaySwitchDuration[o] == nil {
+		relaySwitchDuration[o] = newHistogram(1, 2.5, 5, 10, 20, 30, 60)
+	}
+	relaySwitchDuration[o].observe(d.Seconds())
+}
+
+func observeProbe(d time.Duration, ok bool) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if ok {
+		probes["success"]++
+	} else {
+		probes["failure"]++
+	}
+	probeDuration.observe(d.Seconds())
+}
+
+func observeFirewallError(op string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	firewallErrors[op]++
+}
+
+func observeDnsQuery(result string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	dnsQueries[result]++
+}
+
+type wgPeer struct {
+	Pubkey        string
+	AllowedIps    string
+	LastHandshake int64
+	Rx            uint64
+	Tx            uint64
+}
+
+// wgDump parses `wg show <intf> dump`, the first line describes the interface itself
+func wgDump(intf string) ([]wgPeer, error) {
+	out, err := output(wg, "show", intf, "dump")
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []wgPeer
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for _, line := range lines[min(1, len(lines)):] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 8 {
+			continue
+		}
+
+		peer := wgPeer{Pubkey: fields[0], AllowedIps: fields[3]}
+		peer.LastHandshake, _ = strconv.ParseInt(fields[4], 10, 64)
+		peer.Rx, _ = strconv.ParseUint(fields[5], 10, 64)
+		peer.Tx, _ = strconv.ParseUint(fields[6], 10, 64)
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+
+	fmt.Fprintln(w, "# HELP moleguard_relay_switches_total Relay switches by outcome.")
+	fmt.Fprintln(w, "# TYPE moleguard_relay_switches_total counter")
+	for _, o := range sortedKeys(relaySwitches) {
+		fmt.Fprintf(w, "moleguard_relay_switches_total{outcome=%q} %d\n", o, relaySwitches[o])
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_relay_switch_duration_seconds Time taken by relay switches.")
+	fmt.Fprintln(w, "# TYPE moleguard_relay_switch_duration_seconds histogram")
+	for _, o := range sortedKeys(relaySwitchDuration) {
+		relaySwitchDuration[o].write(w, "moleguard_relay_switch_duration_seconds", fmt.Sprintf("outcome=%q", o))
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_probes_total Connectivity probes by result.")
+	fmt.Fprintln(w, "# TYPE moleguard_probes_total counter")
+	for _, r := range sortedKeys(probes) {
+		fmt.Fprintf(w, "moleguard_probes_total{result=%q} %d\n", r, probes[r])
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_probe_duration_seconds Time taken by connectivity probes.")
+	fmt.Fprintln(w, "# TYPE moleguard_probe_duration_seconds histogram")
+	probeDuration.write(w, "moleguard_probe_duration_seconds", "")
+
+	fmt.Fprintln(w, "# HELP moleguard_firewall_errors_total Failed firewall rule changes.")
+	fmt.Fprintln(w, "# TYPE moleguard_firewall_errors_total counter")
+	for _, op := range sortedKeys(firewallErrors) {
+		fmt.Fprintf(w, "moleguard_firewall_errors_total{op=%q} %d\n", op, firewallErrors[op])
+	}
+
+	fmt.Fprintln(w, "# HELP moleguard_dns_queries_total DNS queries from peers by result.")
+	fmt.Fprintln(w, "# TYPE moleguard_dns_queries_total counter")
+	for _, r := range sortedKeys(dnsQueries) {
+		fmt.Fprintf(w, "moleguard_dns_queries_total{result=%q} %d\n", r, dnsQueries[r])
+	}
+
+	metricsMu.Unlock()
+
+	blocklistMu.RLock()
+	fmt.Fprintln(w, "# HELP moleguard_dns_blocklist_entries Names on the DNS blocklist.")
+	fmt.Fprintln(w, "# TYPE moleguard_dns_blocklist_entries gauge")
+	fmt.Fprintf(w, "moleguard_dns_blocklist_entries %d\n", len(blocklist))
+	blocklistMu.RUnlock()
+
+	now := time.Now().Unix()
+	peers, err := wgDump("wg0")
+	if err == nil {
+		fmt.Fprintln(w, "# HELP moleguard_peer_rx_bytes Bytes received from a peer.")
+		fmt.Fprintln(w, "# TYPE moleguard_peer_rx_bytes counter")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moleguard_peer_rx_bytes{peer=%q,allowed_ips=%q} %d\n", p.Pubkey, p.AllowedIps, p.Rx)
+		}
+
+		fmt.Fprintln(w, "# HELP moleguard_peer_tx_bytes Bytes sent to a peer.")
+		fmt.Fprintln(w, "# TYPE moleguard_peer_tx_bytes counter")
+		for _, p := range peers {
+			fmt.Fprintf(w, "moleguard_peer_tx_bytes{peer=%q,allowed_ips=%q} %d\n", p.Pubkey, p.AllowedIps, p.Tx)
+		}
+
+		fmt.Fprintln(w, "# HELP moleguard_peer_handshake_age_seconds Seconds since the last handshake with a peer.")
+		fmt.Fprintln(w, "# TYPE moleguard_peer_handshake_age_seconds gauge")
+		for _, p := range peers {
+			if p.LastHandshake == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "moleguard_peer_handshake_age_seconds{peer=%q,allowed_ips=%q} %d\n", p.Pubkey, p.AllowedIps, now-p.LastHandshake)
+		}
+	}
+
+	relay, _ := currentRelay()
+	upstream, err := wgDump(relay)
+	if err == nil {
+		var rx, tx uint64
+		for _, p := range upstream {
+			rx += p.Rx
+			tx += p.Tx
+		}
+
+		fmt.Fprintln(w, "# HELP moleguard_upstream_rx_bytes Bytes received through the upstream tunnel.")
+		fmt.Fprintln(w, "# TYPE moleguard_upstream_rx_bytes counter")
+		fmt.Fprintf(w, "moleguard_upstream_rx_bytes{interface=%q} %d\n", relay, rx)
+		fmt.Fprintln(w, "# HELP moleguard_upstream_tx_bytes Bytes sent through the upstream tunnel.")
+		fmt.Fprintln(w, "# TYPE moleguard_upstream_tx_bytes counter")
+		fmt.Fprintf(w, "moleguard_upstream_tx_bytes{interface=%q} %d\n", relay, tx)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var mullvadApi = "https://api.mullvad.net"
+
+// mullvadProvider exits through the per relay configs generated for a mullvad account
+type mullvadProvider struct {
+	confDir     string
+	multihopDir string
+}
+
+func fetchRelays() ([]RelayInfo, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Get(mullvadApi + "/www/relays/wireguard/")
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay list: unexpected status %d", resp.StatusCode)
+	}
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var relays []RelayInfo
+	err = json.Unmarshal(respBytes, &relays)
+
+	return relays, err
+}
+
+// Relays returns the active relays which have a config in confDir
+func (p *mullvadProvider) Relays() ([]RelayInfo, error) {
+	relays, err := fetchRelays()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []RelayInfo
+	for _, relay := range relays {
+		if !relay.Active {
+			continue
+		}
+		if _, err := os.Stat(path.Join(p.confDir, relay.Hostname+".conf")); err != nil {
+			continue
+		}
+
+		out = append(out, relay)
+	}
+
+	return out, nil
+}
+
+func (p *mullvadProvider) Up(relay string) error {
+	return run(wgQuick, "up", path.Join(p.confDir, relay+".conf"))
+}
+
+func (p *mullvadProvider) Down() error {
+	if _, err := os.Stat(p.multihopDir); err == nil {
+		if err := downAll(p.multihopDir); err != nil {
+			return err
+		}
+	}
+
+	return downAll(p.confDir)
+}
+
+// UpMultihop renders the exit's config with the entry relay's address and the
+// exit's multihop port as endpoint, the peer key stays the exit's key
+func (p *mullvadProvider) UpMultihop(relay string, entry string) error {
+	err := validateMultihop(relay, entry)
+	if err != nil {
+		return err
+	}
+
+	exitInfo, _ := lookupRelay(relay)
+	entryInfo, _ := lookupRelay(entry)
+
+	confBytes, err := os.ReadFile(path.Join(p.confDir, relay+".conf"))
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(confBytes), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Endpoint") {
+			lines[i] = fmt.Sprintf("Endpoint = %s:%d", entryInfo.Ipv4AddrIn, exitInfo.MultihopPort)
+		}
+		if strings.HasPrefix(line, "PublicKey") && exitInfo.Pubkey != "" {
+			lines[i] = "PublicKey = " + exitInfo.Pubkey
+		}
+	}
+
+	err = os.MkdirAll(p.multihopDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	confPath := path.Join(p.multihopDir, relay+".conf")
+	err = os.WriteFile(confPath, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		return err
+	}
+
+	return run(wgQuick, "up", confPath)
+}
+
+func (p *mullvadProvider) UpExit(relay string, intf string, table int) error {
+	return upExit(path.Join(p.confDir, relay+".conf"), intf, table)
+}
+
+// PostUp upgrades the tunnel to a post-quantum one when enabled in the node settings
+func (p *mullvadProvider) PostUp(relay string) (bool, error) {
+	if !getSettings().PqUpgrade {
+		return false, nil
+	}
+
+	log.Println("Upgrading tunnel to post quantum-tunnel")
+	err := run(mullvadUpgradeTunnel, "-wg-interface", relay)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type ProbeConfig struct {
+	Targets []string
+	Timeout time.Duration
+	// Bind is one of "interface" (SO_BINDTODEVICE on the relay), "fwmark" or "none"
+	Bind string
+	// Mark is the fwmark routed through the tunnel, it must not be 0 with fwmark
+	Mark      int
+	ExitCheck bool
+	ExitUrl   string
+}
+
+var probeConfig = ProbeConfig{
+	Targets: []string{"1.1.1.1:443", "google.com:443", "github.com:443", "cloudflare.com:443"},
+	Timeout: 5 * time.Second,
+	Bind:    "interface",
+	ExitUrl: "https://am.i.mullvad.net/ip",
+}
+
+// the exit ip is checked at most once a minute per relay
+var lastExitCheck time.Time
+var lastExitRelay string
+var exitCheckMu sync.Mutex
+
+var lastProbe time.Time
+var lastProbeOk bool
+var lastProbeSuccess time.Time
+var probeMu sync.Mutex
+
+// bindInterface makes a dialer's sockets leave through the interface
+func bindInterface(intf string) func(string, string, syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), intf)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+func probeDialer(relay string) *net.Dialer {
+	dialer := &net.Dialer{Timeout: probeConfig.Timeout}
+
+	switch probeConfig.Bind {
+	case "interface":
+		dialer.Control = bindInterface(relay)
+	case "fwmark":
+		dialer.Control = func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, probeConfig.Mark)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	if probeConfig.Bind == "none" {
+		return dialer
+	}
+
+	// names are resolved by the relay's resolver through the tunnel, the
+	// resolver of the container (127.0.0.11 under docker) can't be reached
+	// from inside it and asking it would leak the lookups anyway
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := *dialer
+			d.Resolver = nil
+			return d.DialContext(ctx, network, dnsConfig.Upstream)
+		},
+	}
+
+	return dialer
+}
+
+func checkExitIp(dialer *net.Dialer, relay string) error {
+	client := http.Client{
+		Timeout: probeConfig.Timeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+
+	resp, err := client.Get(probeConfig.ExitUrl)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+
+	observed := strings.TrimSpace(string(respBytes))
+
+	var ipResp struct {
+		Ip string `json:"ip"`
+	}
+	if json.Unmarshal(respBytes, &ipResp) == nil && ipResp.Ip != "" {
+		observed = ipResp.Ip
+	}
+
+	info, ok := lookupRelay(relay)
+	if !ok {
+		return fmt.Errorf("no metadata for relay %s", relay)
+	}
+
+	if observed != info.Ipv4AddrIn {
+		return fmt.Errorf("exit ip is %s, expected %s", observed, info.Ipv4AddrIn)
+	}
+
+	return nil
+}
+
+// netCheck probes the upstream and records the outcome for the status endpoints
+func netCheck() bool {
+	start := time.Now()
+	ok := probe()
+	observeProbe(time.Since(start), ok)
+
+	probeMu.Lock()
+	lastProbe = time.Now()
+	lastProbeOk = ok
+	if ok {
+		lastProbeSuccess = lastProbe
+	}
+	probeMu.Unlock()
+
+	return ok
+}
+
+func probe() bool {
+	relay, _ := currentRelay()
+	if simulator != nil {
+		return simulator.interfaceUp(relay)
+	}
+
+	dialer := probeDialer(relay)
+
+	reachable := false
+	for _, target := range probeConfig.Targets {
+		conn, err := dialer.Dial("tcp", target)
+		if err == nil {
+			conn.Close()
+			reachable = true
+			break
+		}
+
+		log.Printf("Probe %s failed: %s\n", target, err)
+	}
+
+	if !reachable || !probeConfig.ExitCheck {
+		return reachable
+	}
+
+	exitCheckMu.Lock()
+	defer exitCheckMu.Unlock()
+
+	if lastExitRelay == relay && time.Since(lastExitCheck) < time.Minute {
+		return true
+	}
+
+	if err := checkExitIp(dialer, relay); err != nil {
+		log.Printf("Exit ip check failed: %s\n", err)
+		return false
+	}
+
+	lastExitRelay = relay
+	lastExitCheck = time.Now()
+
+	return true
+}
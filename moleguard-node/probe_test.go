@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func useRelays(t *testing.T, relays []RelayInfo) {
+	relayCacheMu.Lock()
+	relayCache = relays
+	relayCacheAt = time.Now()
+	relayCacheMu.Unlock()
+
+	t.Cleanup(func() {
+		relayCacheMu.Lock()
+		relayCache = nil
+		relayCacheAt = time.Time{}
+		relayCacheMu.Unlock()
+	})
+}
+
+func useProbeConfig(t *testing.T, config ProbeConfig) {
+	saved := probeConfig
+	probeConfig = config
+	t.Cleanup(func() { probeConfig = saved })
+}
+
+func TestCheckExitIp(t *testing.T) {
+	useRelays(t, []RelayInfo{{Hostname: "se-mma-wg-005", Ipv4AddrIn: "203.0.113.5"}})
+
+	tests := []struct {
+		name  string
+		relay string
+		body  string
+		ok    bool
+	}{
+		{"plain match", "se-mma-wg-005", "203.0.113.5\n", true},
+		{"json match", "se-mma-wg-005", `{"ip":"203.0.113.5"}`, true},
+		{"plain mismatch", "se-mma-wg-005", "198.51.100.1", false},
+		{"json mismatch", "se-mma-wg-005", `{"ip":"198.51.100.1"}`, false},
+		{"unknown relay", "de-ber-wg-001", "203.0.113.5", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			useProbeConfig(t, ProbeConfig{Timeout: time.Second, Bind: "none", ExitUrl: server.URL})
+
+			err := checkExitIp(probeDialer(tt.relay), tt.relay)
+			if (err == nil) != tt.ok {
+				t.Fatalf("checkExitIp() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// a port that was just freed refuses connections
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	exitIp := "203.0.113.5"
+	exitServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(exitIp))
+	}))
+	defer exitServer.Close()
+
+	useRelays(t, []RelayInfo{{Hostname: "se-mma-wg-005", Ipv4AddrIn: "203.0.113.5"}})
+	setActiveRelay("se-mma-wg-005", "")
+
+	tests := []struct {
+		name      string
+		targets   []string
+		exitCheck bool
+		exitIp    string
+		ok        bool
+	}{
+		{"first target reachable", []string{listener.Addr().String(), closedAddr}, false, "", true},
+		{"later target reachable", []string{closedAddr, listener.Addr().String()}, false, "", true},
+		{"no target reachable", []string{closedAddr}, false, "", false},
+		{"exit ip matches", []string{listener.Addr().String()}, true, "203.0.113.5", true},
+		{"exit ip leaks", []string{listener.Addr().String()}, true, "198.51.100.1", false},
+		{"exit check needs a reachable target", []string{closedAddr}, true, "203.0.113.5", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useProbeConfig(t, ProbeConfig{
+				Targets:   tt.targets,
+				Timeout:   time.Second,
+				Bind:      "none",
+				ExitCheck: tt.exitCheck,
+				ExitUrl:   exitServer.URL,
+			})
+			exitIp = tt.exitIp
+
+			exitCheckMu.Lock()
+			lastExitRelay = ""
+			exitCheckMu.Unlock()
+
+			if got := probe(); got != tt.ok {
+				t.Fatalf("probe() = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProbeCachesExitCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	checks := 0
+	exitServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks++
+		w.Write([]byte("203.0.113.5"))
+	}))
+	defer exitServer.Close()
+
+	useRelays(t, []RelayInfo{
+		{Hostname: "se-mma-wg-005", Ipv4AddrIn: "203.0.113.5"},
+		{Hostname: "se-got-wg-001", Ipv4AddrIn: "203.0.113.5"},
+	})
+	useProbeConfig(t, ProbeConfig{
+		Targets:   []string{listener.Addr().String()},
+		Timeout:   time.Second,
+		Bind:      "none",
+		ExitCheck: true,
+		ExitUrl:   exitServer.URL,
+	})
+
+	exitCheckMu.Lock()
+	lastExitRelay = ""
+	exitCheckMu.Unlock()
+
+	setActiveRelay("se-mma-wg-005", "")
+	probe()
+	probe()
+	if checks != 1 {
+		t.Fatalf("exit ip checked %d times for one relay, want 1", checks)
+	}
+
+	// a relay change checks again
+	setActiveRelay("se-got-wg-001", "")
+	probe()
+	if checks != 2 {
+		t.Fatalf("exit ip checked %d times after a relay change, want 2", checks)
+	}
+}
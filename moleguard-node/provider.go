@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Provider is an upstream the node exits through. Relays are identified by
+// their hostname, which is also used as the name of the wireguard interface.
+type Provider interface {
+	// Relays lists the relays that can be brought up
+	Relays() ([]RelayInfo, error)
+	Up(relay string) error
+	// Down brings every relay of the provider down
+	Down() error
+	// PostUp runs optional steps after the tunnel is up, such as the PQ
+	// upgrade, it reports whether the tunnel was upgraded to post-quantum
+	PostUp(relay string) (bool, error)
+}
+
+// multihopProvider is implemented by providers which can reach an exit relay through an entry relay
+type multihopProvider interface {
+	UpMultihop(relay string, entry string) error
+}
+
+// exitProvider is implemented by providers which can bring up a relay as an
+// additional exit on the given interface and routing table
+type exitProvider interface {
+	UpExit(relay string, intf string, table int) error
+}
+
+var provider Provider
+
+func newProvider(kind string, confDir string) (Provider, error) {
+	switch kind {
+	case "mullvad":
+		return &mullvadProvider{confDir: confDir, multihopDir: path.Join(os.TempDir(), "moleguard-multihop")}, nil
+	case "wireguard":
+		return &wireguardProvider{confDir: confDir, renderDir: path.Join(os.TempDir(), "moleguard-upstream")}, nil
+	}
+
+	return nil, fmt.Errorf("unknown upstream provider: %s", kind)
+}
+
+// wireguardProvider exits through plain wireguard configs placed in confDir.
+// Metadata for the relays can be supplied in confDir/relays.json using the
+// same fields as the mullvad relay list.
+type wireguardProvider struct {
+	confDir   string
+	renderDir string
+}
+
+func (p *wireguardProvider) Relays() ([]RelayInfo, error) {
+	files, err := os.ReadDir(p.confDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta []RelayInfo
+	metaBytes, err := os.ReadFile(path.Join(p.confDir, "relays.json"))
+	if err == nil {
+		err = json.Unmarshal(metaBytes, &meta)
+		if err != nil {
+			return nil, fmt.Errorf("relays.json: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var relays []RelayInfo
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".conf")
+		if !ok || file.IsDir() {
+			continue
+		}
+
+		relay := RelayInfo{Hostname: name, Active: true}
+		for _, m := range meta {
+			if m.Hostname == name {
+				relay = m
+				relay.Active = true
+				break
+			}
+		}
+
+		endpoint, pubkey, err := parsePeer(path.Join(p.confDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if relay.Ipv4AddrIn == "" {
+			relay.Ipv4AddrIn = endpoint
+		}
+		if relay.Pubkey == "" {
+			relay.Pubkey = pubkey
+		}
+
+		relays = append(relays, relay)
+	}
+
+	return relays, nil
+}
+
+// parsePeer returns the endpoint host and public key of the first peer in a config
+func parsePeer(confPath string) (string, string, error) {
+	f, err := os.Open(confPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer f.Close()
+
+	var endpoint, pubkey string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Endpoint":
+			if endpoint == "" {
+				endpoint = value[:max(strings.LastIndex(value, ":"), 0)]
+			}
+		case "PublicKey":
+			if pubkey == "" {
+				pubkey = value
+			}
+		}
+	}
+
+	return endpoint, pubkey, scanner.Err()
+}
+
+// Up renders the config with the fwmark added when it is missing, so the
+// node's own traffic to the endpoint does not loop through the tunnel
+func (p *wireguardProvider) Up(relay string) error {
+	confBytes, err := os.ReadFile(path.Join(p.confDir, relay+".conf"))
+	if err != nil {
+		return err
+	}
+
+	conf := string(confBytes)
+	if !strings.Contains(conf, "FwMark") {
+		conf = strings.Replace(conf, "[Interface]", fmt.Sprintf("[Interface]\nFwMark = %d", fwMark), 1)
+	}
+
+	err = os.MkdirAll(p.renderDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	confPath := path.Join(p.renderDir, relay+".conf")
+	err = os.WriteFile(confPath, []byte(conf), 0600)
+	if err != nil {
+		return err
+	}
+
+	return run(wgQuick, "up", confPath)
+}
+
+func (p *wireguardProvider) UpExit(relay string, intf string, table int) error {
+	return upExit(path.Join(p.confDir, relay+".conf"), intf, table)
+}
+
+func (p *wireguardProvider) Down() error {
+	files, err := os.ReadDir(p.renderDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		_ = quiet(wgQuick, "down", path.Join(p.renderDir, file.Name()))
+	}
+
+	return nil
+}
+
+func (p *wireguardProvider) PostUp(string) (bool, error) {
+	return false, nil
+}
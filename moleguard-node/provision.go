@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// MullvadDevice is the wireguard key registered on the account, stored next to the relay configs
+type MullvadDevice struct {
+	Id          string    `json:"id"`
+	PrivateKey  string    `json:"private_key"`
+	Pubkey      string    `json:"pubkey"`
+	Ipv4Address string    `json:"ipv4_address"`
+	Ipv6Address string    `json:"ipv6_address"`
+	RotatedAt   time.Time `json:"rotated_at"`
+}
+
+type mullvadApiError struct {
+	Status int
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+func (e *mullvadApiError) Error() string {
+	return fmt.Sprintf("mullvad api: %d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+var errKeyLimit = errors.New("the mullvad account has reached its device limit, remove a device in the account settings")
+
+func generateKey() (string, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key.Bytes()),
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+func mullvadRequest(method string, url string, accessToken string, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, mullvadApi+url, reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &mullvadApiError{Status: resp.StatusCode}
+		_ = json.Unmarshal(respBytes, apiErr)
+
+		if apiErr.Code == "MAX_DEVICES_REACHED" || apiErr.Code == "KEY_LIMIT_REACHED" {
+			return fmt.Errorf("%w (%s)", errKeyLimit, apiErr)
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBytes, out)
+}
+
+func mullvadAccessToken(account string) (string, error) {
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err := mullvadRequest("POST", "/auth/v1/token", "", map[string]string{"account_number": account}, &resp)
+	return resp.AccessToken, err
+}
+
+func devicePath(confDir string) string {
+	return path.Join(path.Dir(confDir), "device.json")
+}
+
+func loadDevice(confDir string) (*MullvadDevice, error) {
+	deviceBytes, err := os.ReadFile(devicePath(confDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var device MullvadDevice
+	err = json.Unmarshal(deviceBytes, &device)
+	return &device, err
+}
+
+// saveDevice replaces the stored device, a failed write leaves the previous one in place
+func saveDevice(confDir string, device *MullvadDevice) error {
+	deviceBytes, err := json.MarshalIndent(device, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(path.Dir(devicePath(confDir)), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := devicePath(confDir) + ".tmp"
+	err = os.WriteFile(tmp, deviceBytes, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, devicePath(confDir))
+}
+
+// storeDevice saves a device whose key is registered on the account already,
+// the key would be lost with a failed save so it is retried
+func storeDevice(confDir string, device *MullvadDevice) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt != 0 {
+			time.Sleep(time.Second)
+		}
+
+		err = saveDevice(confDir, device)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to save the mullvad device: %s\n", err)
+	}
+
+	return err
+}
+
+func registerDevice(accessToken string) (*MullvadDevice, error) {
+	privateKey, pubkey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	device := MullvadDevice{PrivateKey: privateKey, RotatedAt: time.Now()}
+	err = mullvadRequest("POST", "/accounts/v1/devices", accessToken, map[string]any{
+		"pubkey":     pubkey,
+		"hijack_dns": false,
+	}, &device)
+	if err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+func deregisterDevice(accessToken string, device *MullvadDevice) error {
+	return mullvadRequest("DELETE", "/accounts/v1/devices/"+device.Id, accessToken, nil, nil)
+}
+
+func rotateDeviceKey(accessToken string, device *MullvadDevice) error {
+	privateKey, pubkey, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	updated := *device
+	err = mullvadRequest("PUT", "/accounts/v1/devices/"+device.Id+"/pubkey", accessToken, map[string]string{
+		"pubkey": pubkey,
+	}, &updated)
+	if err != nil {
+		return err
+	}
+
+	updated.PrivateKey = privateKey
+	updated.RotatedAt = time.Now()
+	*device = updated
+
+	return nil
+}
+
+// renderConfigs writes a config for every wireguard relay and removes the ones that went away
+func renderConfigs(confDir string, device *MullvadDevice) error {
+	relays, err := fetchRelays()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(confDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	rendered := make(map[string]bool)
+	for _, relay := range relays {
+		if relay.Pubkey == "" || relay.Ipv4AddrIn == "" {
+			continue
+		}
+
+		conf := fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s,%s
+DNS = 10.64.0.1
+FwMark = %d
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0,::0/0
+Endpoint = %s:51820
+`, device.PrivateKey, device.Ipv4Address, device.Ipv6Address, fwMark, relay.Pubkey, relay.Ipv4AddrIn)
+
+		err = os.WriteFile(path.Join(confDir, relay.Hostname+".conf"), []byte(conf), 0600)
+		if err != nil {
+			return err
+		}
+		rendered[relay.Hostname+".conf"] = true
+	}
+
+	files, err := os.ReadDir(confDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".conf") && !rendered[file.Name()] {
+			_ = os.Remove(path.Join(confDir, file.Name()))
+		}
+	}
+
+	return nil
+}
+
+// provisionMullvad makes sure a key is registered on the account and the relay configs are rendered for it
+func provisionMullvad(account string, confDir string) error {
+	device, err := loadDevice(confDir)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := mullvadAccessToken(account)
+	if err != nil {
+		return err
+	}
+
+	if device != nil {
+		var current MullvadDevice
+		err = mullvadRequest("GET", "/accounts/v1/devices/"+device.Id, accessToken, nil, &current)
+
+		var apiErr *mullvadApiError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+			log.Println("Registered mullvad device was removed from the account")
+			device = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if device == nil {
+		// a device that can't be stored would be registered again on every start
+		err = os.MkdirAll(path.Dir(devicePath(confDir)), 0700)
+		if err != nil {
+			return err
+		}
+
+		log.Println("Registering a new wireguard key")
+		device, err = registerDevice(accessToken)
+		if err != nil {
+			return err
+		}
+
+		err = storeDevice(confDir, device)
+		if err != nil {
+			if err := deregisterDevice(accessToken, device); err != nil {
+				log.Printf("Failed to remove the unsaved mullvad device %s: %s\n", device.Id, err)
+			}
+			return err
+		}
+	}
+
+	return renderConfigs(confDir, device)
+}
+
+func keyRotationLoop(account string, confDir string, interval time.Duration) {
+	for {
+		time.Sleep(time.Hour)
+
+		device, err := loadDevice(confDir)
+		if err != nil || device == nil || time.Since(device.RotatedAt) < interval {
+			continue
+		}
+
+		log.Println("Rotating mullvad wireguard key")
+
+		accessToken, err := mullvadAccessToken(account)
+		if err == nil {
+			err = rotateDeviceKey(accessToken, device)
+		}
+		if err == nil {
+			// the old key is gone, the configs are rendered with the new one even if it couldn't be saved
+			if err := storeDevice(confDir, device); err != nil {
+				log.Printf("Failed to save the rotated key, it is lost on restart: %s\n", err)
+			}
+			err = renderConfigs(confDir, device)
+		}
+		if err == nil {
+			relay, entry := currentRelay()
+			err = relayChange(relay, entry, "key rotation")
+		}
+		if err != nil {
+			log.Printf("Key rotation failed: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMullvad stands in for the account and relay list endpoints of the mullvad api
+type fakeMullvad struct {
+	mu         sync.Mutex
+	devices    map[string]MullvadDevice
+	nextId     int
+	registered int
+	removed    []string
+	// limit makes registrations fail with the error code of a full account
+	limit string
+}
+
+func newFakeMullvad(t *testing.T) *fakeMullvad {
+	fake := &fakeMullvad{devices: map[string]MullvadDevice{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /auth/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access"})
+	})
+	mux.HandleFunc("GET /www/relays/wireguard/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]RelayInfo{
+			{Hostname: "se-mma-wg-005", Active: true, Ipv4AddrIn: "203.0.113.5", Pubkey: "relay-key-1"},
+			{Hostname: "se-got-wg-001", Active: true, Ipv4AddrIn: "203.0.113.6", Pubkey: "relay-key-2"},
+			{Hostname: "de-ber-wg-001", Active: true},
+		})
+	})
+	mux.HandleFunc("POST /accounts/v1/devices", func(w http.ResponseWriter, r *http.Request) {
+		if !fake.authorized(w, r) {
+			return
+		}
+
+		var body struct {
+			Pubkey string `json:"pubkey"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		if fake.limit != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"code": fake.limit, "detail": "too many devices"})
+			return
+		}
+
+		fake.nextId++
+		fake.registered++
+		device := MullvadDevice{
+			Id:          fmt.Sprintf("device-%d", fake.nextId),
+			Pubkey:      body.Pubkey,
+			Ipv4Address: fmt.Sprintf("10.64.0.%d/32", fake.nextId),
+			Ipv6Address: fmt.Sprintf("fc00:bbbb:bbbb:bb01::%d/128", fake.nextId),
+		}
+		fake.devices[device.Id] = device
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(deviceResponse(device))
+	})
+	mux.HandleFunc("GET /accounts/v1/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !fake.authorized(w, r) {
+			return
+		}
+
+		fake.mu.Lock()
+		device, ok := fake.devices[r.PathValue("id")]
+		fake.mu.Unlock()
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"code": "DEVICE_NOT_FOUND"})
+			return
+		}
+		json.NewEncoder(w).Encode(deviceResponse(device))
+	})
+	mux.HandleFunc("DELETE /accounts/v1/devices/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !fake.authorized(w, r) {
+			return
+		}
+
+		fake.mu.Lock()
+		delete(fake.devices, r.PathValue("id"))
+		fake.removed = append(fake.removed, r.PathValue("id"))
+		fake.mu.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("PUT /accounts/v1/devices/{id}/pubkey", func(w http.ResponseWriter, r *http.Request) {
+		if !fake.authorized(w, r) {
+			return
+		}
+
+		var body struct {
+			Pubkey string `json:"pubkey"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		device, ok := fake.devices[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		device.Pubkey = body.Pubkey
+		fake.devices[device.Id] = device
+
+		json.NewEncoder(w).Encode(deviceResponse(device))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	saved := mullvadApi
+	mullvadApi = server.URL
+	t.Cleanup(func() { mullvadApi = saved })
+
+	return fake
+}
+
+// deviceResponse is a device as the api returns it, without the private key
+func deviceResponse(device MullvadDevice) map[string]string {
+	return map[string]string{
+		"id":           device.Id,
+		"pubkey":       device.Pubkey,
+		"ipv4_address": device.Ipv4Address,
+		"ipv6_address": device.Ipv6Address,
+	}
+}
+
+func (f *fakeMullvad) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer access" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (f *fakeMullvad) add(device MullvadDevice) {
+	f.mu.Lock()
+	f.devices[device.Id] = device
+	f.mu.Unlock()
+}
+
+func publicKeyOf(t *testing.T, privateKey string) string {
+	keyBytes, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+func TestProvisionMullvad(t *testing.T) {
+	stored := MullvadDevice{
+		Id:          "device-stored",
+		PrivateKey:  "stored-private-key",
+		Pubkey:      "stored-pubkey",
+		Ipv4Address: "10.64.1.1/32",
+		Ipv6Address: "fc00:bbbb:bbbb:bb01::1:1/128",
+	}
+
+	tests := []struct {
+		name string
+		// stored is written to device.json before provisioning
+		stored *MullvadDevice
+		// onAccount is the device the account has registered
+		onAccount *MullvadDevice
+		limit     string
+		// registers tells whether a new key is registered
+		registers bool
+		err       error
+	}{
+		{name: "fresh node", registers: true},
+		{name: "stored device still registered", stored: &stored, onAccount: &stored},
+		{name: "stored device removed from the account", stored: &stored, registers: true},
+		{name: "device limit", limit: "MAX_DEVICES_REACHED", err: errKeyLimit},
+		{name: "key limit", limit: "KEY_LIMIT_REACHED", err: errKeyLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeMullvad(t)
+			fake.limit = tt.limit
+			if tt.onAccount != nil {
+				fake.add(*tt.onAccount)
+			}
+
+			confDir := path.Join(t.TempDir(), "wg0")
+			if tt.stored != nil {
+				if err := saveDevice(confDir, tt.stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// a relay that went away loses its config
+			if err := os.MkdirAll(confDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path.Join(confDir, "gone-wg-001.conf"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := provisionMullvad("1234567890123456", confDir)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("provisionMullvad() = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("provisionMullvad() = %v", err)
+			}
+
+			registered := fake.registered != 0
+			if registered != tt.registers {
+				t.Fatalf("registered a key: %v, want %v", registered, tt.registers)
+			}
+
+			device, err := loadDevice(confDir)
+			if err != nil || device == nil {
+				t.Fatalf("loadDevice() = %v, %v", device, err)
+			}
+			if tt.registers {
+				if device.Pubkey != publicKeyOf(t, device.PrivateKey) {
+					t.Fatal("the stored private key doesn't belong to the registered pubkey")
+				}
+			} else if device.Id != stored.Id || device.PrivateKey != stored.PrivateKey {
+				t.Fatalf("the stored device was replaced: %+v", device)
+			}
+
+			conf, err := os.ReadFile(path.Join(confDir, "se-mma-wg-005.conf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{
+				"PrivateKey = " + device.PrivateKey,
+				"Address = " + device.Ipv4Address + "," + device.Ipv6Address,
+				"PublicKey = relay-key-1",
+				"Endpoint = 203.0.113.5:51820",
+			} {
+				if !strings.Contains(string(conf), want) {
+					t.Errorf("config lacks %q:\n%s", want, conf)
+				}
+			}
+
+			if _, err := os.Stat(path.Join(confDir, "se-got-wg-001.conf")); err != nil {
+				t.Error(err)
+			}
+			// without a pubkey or an address there is nothing to connect to
+			if _, err := os.Stat(path.Join(confDir, "de-ber-wg-001.conf")); err == nil {
+				t.Error("rendered a config for a relay without a pubkey")
+			}
+			if _, err := os.Stat(path.Join(confDir, "gone-wg-001.conf")); err == nil {
+				t.Error("kept the config of a relay that went away")
+			}
+		})
+	}
+}
+
+func TestProvisionMullvadDeregistersUnsavedDevice(t *testing.T) {
+	fake := newFakeMullvad(t)
+
+	confDir := path.Join(t.TempDir(), "wg0")
+	// the temporary file of the save can't be written
+	if err := os.MkdirAll(devicePath(confDir)+".tmp/blocked", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provisionMullvad("1234567890123456", confDir); err == nil {
+		t.Fatal("provisionMullvad() succeeded without saving the device")
+	}
+
+	if fake.registered != 1 || len(fake.removed) != 1 || len(fake.devices) != 0 {
+		t.Fatalf("registered %d, removed %v, left %d devices on the account", fake.registered, fake.removed, len(fake.devices))
+	}
+}
+
+func TestRotateDeviceKey(t *testing.T) {
+	fake := newFakeMullvad(t)
+
+	device := MullvadDevice{Id: "device-1", PrivateKey: "old-private-key", Pubkey: "old-pubkey", Ipv4Address: "10.64.0.1/32"}
+	fake.add(device)
+
+	if err := rotateDeviceKey("access", &device); err != nil {
+		t.Fatal(err)
+	}
+
+	if device.PrivateKey == "old-private-key" || device.RotatedAt.IsZero() {
+		t.Fatalf("the key wasn't replaced: %+v", device)
+	}
+	if device.Pubkey != publicKeyOf(t, device.PrivateKey) || fake.devices["device-1"].Pubkey != device.Pubkey {
+		t.Fatal("the account doesn't have the new pubkey")
+	}
+	if device.Ipv4Address != "10.64.0.1/32" {
+		t.Fatalf("the address changed: %s", device.Ipv4Address)
+	}
+
+	missing := MullvadDevice{Id: "device-missing", PrivateKey: "old-private-key"}
+	if err := rotateDeviceKey("access", &missing); err == nil || missing.PrivateKey != "old-private-key" {
+		t.Fatalf("rotating a removed device = %v, key %s", err, missing.PrivateKey)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fwMark is the mark set on the upstream configs, traffic carrying it bypasses the tunnel
+const fwMark = 51820
+
+type RelayInfo struct {
+	Hostname     string `json:"hostname"`
+	CountryCode  string `json:"country_code"`
+	CountryName  string `json:"country_name"`
+	CityCode     string `json:"city_code"`
+	CityName     string `json:"city_name"`
+	Active       bool   `json:"active"`
+	Owned        bool   `json:"owned"`
+	Provider     string `json:"provider"`
+	Ipv4AddrIn   string `json:"ipv4_addr_in"`
+	Pubkey       string `json:"pubkey"`
+	MultihopPort int    `json:"multihop_port"`
+	Daita        bool   `json:"daita"`
+}
+
+type RelayFilter struct {
+	Countries []string `json:"countries,omitempty"`
+	Cities    []string `json:"cities,omitempty"`
+	Owned     bool     `json:"owned,omitempty"`
+	Daita     bool     `json:"daita,omitempty"`
+}
+
+type RelayCandidate struct {
+	Hostname    string  `json:"hostname"`
+	CountryCode string  `json:"country_code"`
+	CityCode    string  `json:"city_code"`
+	Owned       bool    `json:"owned"`
+	Daita       bool    `json:"daita"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Error       string  `json:"error,omitempty"`
+}
+
+type RelayRanking struct {
+	RankedAt   time.Time        `json:"ranked_at"`
+	Filter     RelayFilter      `json:"filter"`
+	Port       int              `json:"port"`
+	Chosen     string           `json:"chosen"`
+	Reason     string           `json:"reason"`
+	Candidates []RelayCandidate `json:"candidates"`
+}
+
+var relayFilter RelayFilter
+var relayProbePort = 443
+
+var lastRanking *RelayRanking
+var rankingMu sync.Mutex
+
+var relayCache []RelayInfo
+var relayCacheAt time.Time
+var relayCacheMu sync.Mutex
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+func (f RelayFilter) match(relay RelayInfo) bool {
+	if len(f.Countries) != 0 && !slices.Contains(f.Countries, relay.CountryCode) {
+		return false
+	}
+	if len(f.Cities) != 0 && !slices.Contains(f.Cities, relay.CityCode) {
+		return false
+	}
+	if f.Owned && !relay.Owned {
+		return false
+	}
+	if f.Daita && !relay.Daita {
+		return false
+	}
+
+	return true
+}
+
+// availableRelays lists the relays of the upstream provider and refreshes the cache used by lookupRelay
+func availableRelays() ([]RelayInfo, error) {
+	relays, err := provider.Relays()
+	if err != nil {
+		return nil, err
+	}
+
+	relayCacheMu.Lock()
+	relayCache = relays
+	relayCacheAt = time.Now()
+	relayCacheMu.Unlock()
+
+	return relays, nil
+}
+
+// lookupRelay returns the metadata of a relay, the catalogue is refreshed hourly
+func lookupRelay(hostname string) (RelayInfo, bool) {
+	relayCacheMu.Lock()
+	relays := relayCache
+	stale := time.Since(relayCacheAt) > time.Hour
+	relayCacheMu.Unlock()
+
+	if stale {
+		fetched, err := availableRelays()
+		if err != nil {
+			log.Printf("Failed to refresh relay list: %s\n", err)
+		} else {
+			relays = fetched
+		}
+	}
+
+	for _, relay := range relays {
+		if relay.Hostname == hostname {
+			return relay, true
+		}
+	}
+
+	return RelayInfo{}, false
+}
+
+func markControl(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, fwMark)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// measureLatency returns the fastest of a few tcp handshakes with the relay,
+// dialed with the fwmark so the active tunnel is bypassed
+func measureLatency(ip string, port int) (time.Duration, error) {
+	if simulator != nil {
+		return simLatency(ip), nil
+	}
+
+	dialer := net.Dialer{Timeout: 3 * time.Second, Control: markControl}
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+
+	best := time.Duration(0)
+	var lastErr error
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		elapsed := time.Since(start)
+		conn.Close()
+
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+
+	if best == 0 {
+		return 0, lastErr
+	}
+
+	return best, nil
+}
+
+func rankRelays() (*RelayRanking, error) {
+	relays, err := availableRelays()
+	if err != nil {
+		return nil, err
+	}
+
+	ranking := RelayRanking{
+		RankedAt: time.Now(),
+		Filter:   relayFilter,
+		Port:     relayProbePort,
+	}
+
+	var matching []RelayInfo
+	for _, relay := range relays {
+		if relayFilter.match(relay) {
+			matching = append(matching, relay)
+		}
+	}
+
+	for _, relay := range preferDaita(matching) {
+		ranking.Candidates = append(ranking.Candidates, RelayCandidate{
+			Hostname:    relay.Hostname,
+			CountryCode: relay.CountryCode,
+			CityCode:    relay.CityCode,
+			Owned:       relay.Owned,
+			Daita:       relay.Daita,
+		})
+	}
+
+	if len(ranking.Candidates) == 0 {
+		return nil, errors.New("no relays match the filter")
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 16)
+	for i := range ranking.Candidates {
+		wg.Add(1)
+		go func(c *RelayCandidate) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			relay := relays[slices.IndexFunc(relays, func(r RelayInfo) bool { return r.Hostname == c.Hostname })]
+			latency, err := measureLatency(relay.Ipv4AddrIn, relayProbePort)
+			if err != nil {
+				c.Error = err.Error()
+				return
+			}
+
+			c.LatencyMs = float64(latency.Microseconds()) / 1000
+		}(&ranking.Candidates[i])
+	}
+	wg.Wait()
+
+	slices.SortStableFunc(ranking.Candidates, func(a, b RelayCandidate) int {
+		if (a.Error == "") != (b.Error == "") {
+			if a.Error == "" {
+				return -1
+			}
+			return 1
+		}
+		if a.LatencyMs < b.LatencyMs {
+			return -1
+		}
+		if a.LatencyMs > b.LatencyMs {
+			return 1
+		}
+		return strings.Compare(a.Hostname, b.Hostname)
+	})
+
+	best := ranking.Candidates[0]
+	if best.Error != "" {
+		return &ranking, errors.New("no relay could be reached")
+	}
+
+	ranking.Chosen = best.Hostname
+	ranking.Reason = fmt.Sprintf("lowest tcp handshake latency (%.1fms) of %d candidates", best.LatencyMs, len(ranking.Candidates))
+
+	return &ranking, nil
+}
+
+func storeRanking(ranking *RelayRanking) {
+	rankingMu.Lock()
+	defer rankingMu.Unlock()
+
+	lastRanking = ranking
+}
+
+// autoRelayLoop periodically re-ranks the relays and switches if the active one is
+// either unreachable or at least 20% slower than the best candidate
+func autoRelayLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		ranking, err := rankRelays()
+		if err != nil {
+			if ranking != nil {
+				storeRanking(ranking)
+			}
+			log.Printf("Failed to rank relays: %s\n", err)
+			continue
+		}
+
+		active, _ := currentRelay()
+		current := slices.IndexFunc(ranking.Candidates, func(c RelayCandidate) bool { return c.Hostname == active })
+		if ranking.Chosen != active && current != -1 && ranking.Candidates[current].Error == "" &&
+			ranking.Candidates[0].LatencyMs > ranking.Candidates[current].LatencyMs*0.8 {
+			ranking.Reason = fmt.Sprintf("keeping %s (%.1fms), %s is less than 20%% faster",
+				active, ranking.Candidates[current].LatencyMs, ranking.Chosen)
+			ranking.Chosen = active
+		}
+
+		storeRanking(ranking)
+		if ranking.Chosen == active {
+			continue
+		}
+
+		log.Printf("Switching to %s: %s\n", ranking.Chosen, ranking.Reason)
+		if err := relayChange(ranking.Chosen, "", "auto: "+ranking.Reason); err != nil {
+			log.Printf("Failed to switch relay: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RotationPolicy struct {
+	Enabled   bool     `json:"enabled"`
+	Interval  string   `json:"interval"`
+	Countries []string `json:"countries,omitempty"`
+	Providers []string `json:"providers,omitempty"`
+	NoRepeat  int      `json:"no_repeat"`
+}
+
+// by default the node only keeps the schedule, the controller runs due rotations
+// through POST /rotation/rotate so they take the same lock and cooldown as manual
+// changes. A node without a controller runs them itself with ROTATION_SCHEDULER=node.
+type RotationState struct {
+	Policy       RotationPolicy `json:"policy"`
+	Recent       []string       `json:"recent"`
+	LastRotation time.Time      `json:"last_rotation"`
+	NextRotation time.Time      `json:"next_rotation"`
+	Scheduler    string         `json:"scheduler"`
+}
+
+var rotation RotationState
+var rotationMu sync.Mutex
+var rotationReset = make(chan struct{}, 1)
+
+// manualChange counts the operator requested relay changes that are running,
+// rotations are refused until they are done
+var manualChange atomic.Int32
+
+func (p RotationPolicy) validate() error {
+	if !p.Enabled {
+		return nil
+	}
+
+	d, err := time.ParseDuration(p.Interval)
+	if err != nil {
+		return err
+	}
+	if d < time.Minute {
+		return errors.New("interval must be at least 1m")
+	}
+	if p.NoRepeat < 0 {
+		return errors.New("no_repeat can't be negative")
+	}
+
+	return nil
+}
+
+func setRotationPolicy(policy RotationPolicy) {
+	rotationMu.Lock()
+	rotation.Policy = policy
+	if policy.Enabled {
+		d, _ := time.ParseDuration(policy.Interval)
+		rotation.NextRotation = time.Now().Add(d)
+	} else {
+		rotation.NextRotation = time.Time{}
+	}
+	rotationMu.Unlock()
+
+	saveState()
+
+	select {
+	case rotationReset <- struct{}{}:
+	default:
+	}
+}
+
+// pickRotationRelay picks the next exit relay, with multihop it has to be
+// reachable from the entry relay
+func pickRotationRelay(policy RotationPolicy, recent []string, active string, entry string) (string, error) {
+	relays, err := availableRelays()
+	if err != nil {
+		return "", err
+	}
+
+	if len(recent) > policy.NoRepeat {
+		recent = recent[len(recent)-policy.NoRepeat:]
+	}
+
+	var matching []RelayInfo
+	for _, relay := range relays {
+		if len(policy.Countries) != 0 && !slices.Contains(policy.Countries, relay.CountryCode) {
+			continue
+		}
+		if len(policy.Providers) != 0 && !slices.Contains(policy.Providers, relay.Provider) {
+			continue
+		}
+
+		matching = append(matching, relay)
+	}
+
+	var pool, fallback []string
+	for _, relay := range preferDaita(matching) {
+		if relay.Hostname == active {
+			continue
+		}
+		if entry != "" && (relay.Hostname == entry || relay.MultihopPort == 0) {
+			continue
+		}
+
+		fallback = append(fallback, relay.Hostname)
+		if !slices.Contains(recent, relay.Hostname) {
+			pool = append(pool, relay.Hostname)
+		}
+	}
+
+	if len(pool) == 0 {
+		// the pool is smaller than no_repeat, only avoid staying on the same relay
+		pool = fallback
+	}
+	if len(pool) == 0 {
+		return "", errors.New("no relays match the rotation policy")
+	}
+
+	return pool[rand.IntN(len(pool))], nil
+}
+
+// rotate switches to the next relay of the policy and schedules the following rotation
+func rotate(reason string) (string, string, error) {
+	rotationMu.Lock()
+	policy := rotation.Policy
+	recent := slices.Clone(rotation.Recent)
+	rotationMu.Unlock()
+
+	interval, _ := time.ParseDuration(policy.Interval)
+
+	// a multihop node keeps its entry relay, only the exit rotates
+	active, entry := currentRelay()
+	relay, err := pickRotationRelay(policy, recent, active, entry)
+	if err != nil {
+		log.Printf("Rotation failed: %s\n", err)
+
+		rotationMu.Lock()
+		rotation.NextRotation = time.Now().Add(interval)
+		rotationMu.Unlock()
+		return "", "", err
+	}
+
+	log.Printf("Rotating to: %s\n", relay)
+	err = relayChange(relay, entry, reason)
+	if err != nil {
+		log.Printf("Rotation failed: %s\n", err)
+	}
+
+	rotationMu.Lock()
+	if err == nil {
+		rotation.Recent = append(rotation.Recent, relay)
+		if len(rotation.Recent) > 64 {
+			rotation.Recent = rotation.Recent[len(rotation.Recent)-64:]
+		}
+		rotation.LastRotation = time.Now()
+	}
+	rotation.NextRotation = time.Now().Add(interval)
+	rotationMu.Unlock()
+
+	saveState()
+	return relay, entry, err
+}
+
+// rotationLoop runs the due rotations of a node with ROTATION_SCHEDULER=node
+func rotationLoop() {
+	for {
+		rotationMu.Lock()
+		enabled := rotation.Policy.Enabled
+		next := rotation.NextRotation
+		rotationMu.Unlock()
+
+		wait := time.Hour
+		if enabled {
+			wait = time.Until(next)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-rotationReset:
+			continue
+		}
+
+		if !enabled || time.Now().Before(next) {
+			continue
+		}
+
+		if manualChange.Load() != 0 {
+			log.Println("Relay change in progress, deferring rotation")
+
+			rotationMu.Lock()
+			rotation.NextRotation = time.Now().Add(30 * time.Second)
+			rotationMu.Unlock()
+			continue
+		}
+
+		rotate("scheduled rotation")
+	}
+}
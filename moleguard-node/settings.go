@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type NodeSettings struct {
+	PqUpgrade   bool `json:"pq_upgrade"`
+	PreferDaita bool `json:"prefer_daita"`
+}
+
+var settings NodeSettings
+var settingsMu sync.Mutex
+
+// pqUpgraded reports whether the active tunnel went through the post-quantum upgrade
+var pqUpgraded atomic.Bool
+
+// postUpGen is bumped on every tunnel change so stale post-up retries stop
+var postUpGen atomic.Int64
+
+func getSettings() NodeSettings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	return settings
+}
+
+func setSettings(s NodeSettings) {
+	settingsMu.Lock()
+	old := settings
+	settings = s
+	settingsMu.Unlock()
+
+	saveState()
+
+	// the upgrade can be applied to the live tunnel, turning it off takes effect on the next switch
+	if s.PqUpgrade && !old.PqUpgrade && !pqUpgraded.Load() {
+		relay, _ := currentRelay()
+		startPostUp(relay)
+	}
+}
+
+// startPostUp runs the provider's post-up steps in the background, a failure
+// does not fail the relay switch but is retried with backoff
+func startPostUp(relay string) {
+	gen := postUpGen.Add(1)
+
+	go func() {
+		delay := 5 * time.Second
+		for attempt := 1; attempt <= 6; attempt++ {
+			if postUpGen.Load() != gen {
+				return
+			}
+
+			upgraded, err := provider.PostUp(relay)
+			if err == nil {
+				// the tunnel may have changed while the upgrade ran, switches
+				// bump the generation under wgMutex
+				wgMutex.Lock()
+				if upgraded && postUpGen.Load() == gen {
+					pqUpgraded.Store(true)
+				}
+				wgMutex.Unlock()
+				return
+			}
+
+			log.Printf("Post-up for %s failed (attempt %d): %s\n", relay, attempt, err)
+
+			time.Sleep(delay)
+			delay = min(delay*2, 5*time.Minute)
+		}
+
+		log.Printf("Giving up on post-up for %s\n", relay)
+	}()
+}
+
+// preferDaita narrows the relays to the DAITA capable ones when that is
+// preferred and at least one of them is available
+func preferDaita(relays []RelayInfo) []RelayInfo {
+	if !getSettings().PreferDaita {
+		return relays
+	}
+
+	var daita []RelayInfo
+	for _, relay := range relays {
+		if relay.Daita {
+			daita = append(daita, relay)
+		}
+	}
+
+	if len(daita) == 0 {
+		return relays
+	}
+	return daita
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// in simulate mode the external commands are faked, wg-quick, iptables, wg and
+// ip keep just enough state for the node to run without NET_ADMIN or a
+// mullvad account, and every command is recorded
+
+type SimCommand struct {
+	Seq     int       `json:"seq"`
+	At      time.Time `json:"at"`
+	Command string    `json:"command"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type simPeer struct {
+	Pubkey     string
+	AllowedIps string
+}
+
+type simInterface struct {
+	Pubkey   string
+	Peer     string
+	Endpoint string
+	Since    time.Time
+}
+
+type simExecutor struct {
+	mu         sync.Mutex
+	commands   []SimCommand
+	seq        int
+	interfaces map[string]*simInterface
+	// chains holds the rules of each "table/chain"
+	chains map[string][]string
+	// ipRules holds the routing rules as selector and value pairs
+	ipRules []map[string]string
+	peers   []simPeer
+}
+
+// simulator is set when the node runs with -simulate
+var simulator *simExecutor
+
+// only the most recent commands are kept
+const maxSimCommands = 1000
+
+var builtinChains = []string{"INPUT", "OUTPUT", "FORWARD", "PREROUTING", "POSTROUTING"}
+
+func newSimExecutor(peers []simPeer) *simExecutor {
+	return &simExecutor{
+		interfaces: map[string]*simInterface{"wg0": {Pubkey: simKey("wg0"), Since: time.Now()}},
+		chains:     map[string][]string{},
+		peers:      peers,
+	}
+}
+
+// simKey derives a stable fake wireguard key from a name
+func simKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (s *simExecutor) Run(name string, args ...string) error {
+	_, err := s.Output(name, args...)
+	return err
+}
+
+func (s *simExecutor) Output(name string, args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out, err := s.exec(path.Base(name), args)
+
+	command := strings.Join(append([]string{name}, args...), " ")
+	s.seq++
+	c := SimCommand{Seq: s.seq, At: time.Now(), Command: command}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	s.commands = append(s.commands, c)
+	if len(s.commands) > maxSimCommands {
+		s.commands = s.commands[len(s.commands)-maxSimCommands:]
+	}
+
+	if err != nil {
+		log.Printf("[simulate] %s: %s\n", command, err)
+	} else {
+		log.Printf("[simulate] %s\n", command)
+	}
+
+	return out, err
+}
+
+// Commands returns the recorded commands after the given sequence number
+func (s *simExecutor) Commands(since int) []SimCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	commands := []SimCommand{}
+	for _, c := range s.commands {
+		if c.Seq > since {
+			commands = append(commands, c)
+		}
+	}
+
+	return commands
+}
+
+func (s *simExecutor) interfaceUp(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.interfaces[name]
+	return ok
+}
+
+func (s *simExecutor) exec(name string, args []string) ([]byte, error) {
+	switch name {
+	case "wg-quick":
+		return nil, s.wgQuick(args)
+	case "iptables":
+		return nil, s.iptables(args)
+	case "wg":
+		return s.wg(args)
+	case "ip":
+		return nil, s.ip(args)
+	case "mullvad-upgrade-tunnel":
+		if len(args) != 2 || args[0] != "-wg-interface" {
+			return nil, errors.New("usage: mullvad-upgrade-tunnel -wg-interface <interface>")
+		}
+		if _, ok := s.interfaces[args[1]]; !ok {
+			return nil, fmt.Errorf("interface %s does not exist", args[1])
+		}
+		return nil, nil
+	}
+
+	return nil, nil
+}
+
+func (s *simExecutor) wgQuick(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: wg-quick up|down <config>")
+	}
+
+	intf := strings.TrimSuffix(path.Base(args[1]), ".conf")
+	_, up := s.interfaces[intf]
+
+	switch args[0] {
+	case "up":
+		if up {
+			return fmt.Errorf("`%s' already exists", intf)
+		}
+
+		confBytes, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+
+		state := &simInterface{Pubkey: simKey(intf), Since: time.Now()}
+		for _, line := range strings.Split(string(confBytes), "\n") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			switch strings.TrimSpace(key) {
+			case "PublicKey":
+				state.Peer = strings.TrimSpace(value)
+			case "Endpoint":
+				state.Endpoint = strings.TrimSpace(value)
+			}
+		}
+		if state.Peer == "" {
+			return fmt.Errorf("%s has no peer", args[1])
+		}
+
+		s.interfaces[intf] = state
+	case "down":
+		if !up {
+			return fmt.Errorf("`%s' is not a WireGuard interface", intf)
+		}
+		delete(s.interfaces, intf)
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+
+	return nil
+}
+
+func (s *simExecutor) iptables(args []string) error {
+	table := "filter"
+	if len(args) >= 2 && args[0] == "-t" {
+		table = args[1]
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return errors.New("iptables: missing chain")
+	}
+
+	op, chain, rule := args[0], args[1], strings.Join(args[2:], " ")
+	key := table + "/" + chain
+	rules, exists := s.chains[key]
+	exists = exists || slices.Contains(builtinChains, chain)
+
+	if op != "-N" && !exists {
+		return fmt.Errorf("iptables: chain %s does not exist in table %s", chain, table)
+	}
+
+	switch op {
+	case "-N":
+		if exists {
+			return errors.New("iptables: Chain already exists.")
+		}
+		s.chains[key] = []string{}
+	case "-X":
+		delete(s.chains, key)
+	case "-F":
+		s.chains[key] = []string{}
+	case "-A":
+		s.chains[key] = append(rules, rule)
+	case "-I":
+		s.chains[key] = append([]string{rule}, rules...)
+	case "-D", "-C":
+		i := slices.Index(rules, rule)
+		if i == -1 {
+			return errors.New("iptables: Bad rule (does a matching rule exist in that chain?).")
+		}
+		if op == "-D" {
+			s.chains[key] = slices.Delete(rules, i, i+1)
+		}
+	default:
+		return fmt.Errorf("iptables: unsupported option %s", op)
+	}
+
+	return nil
+}
+
+func (s *simExecutor) ip(args []string) error {
+	if len(args) == 3 && args[0] == "link" && args[1] == "del" {
+		if _, ok := s.interfaces[args[2]]; !ok {
+			return fmt.Errorf("cannot find device %q", args[2])
+		}
+		delete(s.interfaces, args[2])
+		return nil
+	}
+
+	if len(args) < 2 || args[0] != "rule" {
+		return nil
+	}
+
+	// "from 10.13.13.2 lookup 1001 priority 1000"
+	if len(args[2:])%2 != 0 {
+		return errors.New("ip rule: expected selector and value pairs")
+	}
+	rule := map[string]string{}
+	for i := 2; i < len(args); i += 2 {
+		rule[args[i]] = args[i+1]
+	}
+
+	switch args[1] {
+	case "add":
+		s.ipRules = append(s.ipRules, rule)
+	case "del":
+		// like ip, the first rule matching everything given is deleted
+		for i, r := range s.ipRules {
+			match := true
+			for k, v := range rule {
+				if r[k] != v {
+					match = false
+				}
+			}
+			if match {
+				s.ipRules = slices.Delete(s.ipRules, i, i+1)
+				return nil
+			}
+		}
+		return errors.New("RTNETLINK answers: No such file or directory")
+	}
+
+	return nil
+}
+
+func (s *simExecutor) wg(args []string) ([]byte, error) {
+	if len(args) == 2 && args[0] == "show" && args[1] == "interfaces" {
+		var names []string
+		for name := range s.interfaces {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		return []byte(strings.Join(names, " ") + "\n"), nil
+	}
+
+	if len(args) != 3 || args[0] != "show" {
+		return nil, errors.New("usage: wg show <interface> dump|latest-handshakes|peers")
+	}
+
+	state, ok := s.interfaces[args[1]]
+	if !ok {
+		return nil, fmt.Errorf("unable to access interface %s", args[1])
+	}
+
+	// peers handshake every two minutes and move traffic at a steady rate
+	now := time.Now()
+	up := int64(now.Sub(state.Since).Seconds())
+
+	peers := s.peers
+	if args[1] != "wg0" {
+		peers = []simPeer{{Pubkey: state.Peer, AllowedIps: "0.0.0.0/0,::/0"}}
+	}
+
+	out := strings.Builder{}
+	if args[2] == "dump" {
+		fmt.Fprintf(&out, "(hidden)\t%s\t51820\toff\n", state.Pubkey)
+	}
+	for i, peer := range peers {
+		handshake := now.Unix() - (int64(i)*17)%120
+		rx := up * int64(i+1) * 1500
+		tx := up * int64(i+1) * 400
+
+		switch args[2] {
+		case "dump":
+			endpoint := state.Endpoint
+			if args[1] == "wg0" {
+				endpoint = fmt.Sprintf("192.0.2.%d:51820", i%254+1)
+			}
+			fmt.Fprintf(&out, "%s\t(none)\t%s\t%s\t%d\t%d\t%d\toff\n", peer.Pubkey, endpoint, peer.AllowedIps, handshake, rx, tx)
+		case "latest-handshakes":
+			fmt.Fprintf(&out, "%s\t%d\n", peer.Pubkey, handshake)
+		case "peers":
+			fmt.Fprintf(&out, "%s\n", peer.Pubkey)
+		default:
+			return nil, fmt.Errorf("invalid parameter %s", args[2])
+		}
+	}
+
+	return []byte(out.String()), nil
+}
+
+// simLatency stands in for a relay's latency, it is stable per address
+func simLatency(ip string) time.Duration {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+
+	return time.Duration(10+h.Sum32()%190) * time.Millisecond
+}
+
+// simulateSetup writes what the wireguard image and mullvad provisioning would
+// otherwise provide: peer configs in peerDir and, for the mullvad upstream,
+// relay configs in confDir for every relay of the catalogue
+func simulateSetup(peerDir string, peerCount int, upstream string, confDir string, defaultRelay string) ([]simPeer, error) {
+	serverDir := path.Join(peerDir, "server")
+	if err := os.MkdirAll(serverDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path.Join(serverDir, "publickey-server"), []byte(simKey("wg0")+"\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	var peers []simPeer
+	for i := 1; i <= peerCount; i++ {
+		name := fmt.Sprintf("peer%d", i)
+		address := fmt.Sprintf("10.13.13.%d", i+1)
+
+		conf := fmt.Sprintf(`[Interface]
+Address = %s
+PrivateKey = %s
+ListenPort = 51820
+DNS = 10.13.13.1
+
+[Peer]
+PublicKey = %s
+PresharedKey = %s
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 0.0.0.0/0
+`, address, simKey(name+"-private"), simKey("wg0"), simKey(name+"-psk"))
+
+		if err := os.MkdirAll(path.Join(peerDir, name), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path.Join(peerDir, name, name+".conf"), []byte(conf), 0600); err != nil {
+			return nil, err
+		}
+
+		peers = append(peers, simPeer{Pubkey: simKey(name), AllowedIps: address + "/32"})
+	}
+
+	if upstream != "mullvad" {
+		return peers, nil
+	}
+
+	privateKey, pubkey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	device := &MullvadDevice{
+		Id:          "simulated",
+		PrivateKey:  privateKey,
+		Pubkey:      pubkey,
+		Ipv4Address: "10.64.0.2/32",
+		Ipv6Address: "fc00:bbbb:bbbb:bb01::2/128",
+	}
+	err = renderConfigs(confDir, device)
+	if err == nil {
+		return peers, nil
+	}
+	if defaultRelay == "" {
+		return nil, err
+	}
+	log.Printf("Failed to fetch the relay list, only simulating %s: %s\n", defaultRelay, err)
+
+	if err := os.MkdirAll(confDir, 0700); err != nil {
+		return nil, err
+	}
+
+	conf := fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s,%s
+FwMark = %d
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0,::0/0
+Endpoint = 192.0.2.1:51820
+`, device.PrivateKey, device.Ipv4Address, device.Ipv6Address, fwMark, simKey(defaultRelay))
+
+	return peers, os.WriteFile(path.Join(confDir, defaultRelay+".conf"), []byte(conf), 0600)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type RelaySwitch struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Entry  string    `json:"entry,omitempty"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error,omitempty"`
+}
+
+type NodeState struct {
+	ActiveRelay string        `json:"active_relay"`
+	ActiveEntry string        `json:"active_entry,omitempty"`
+	History     []RelaySwitch `json:"history"`
+	Rotation    RotationState `json:"rotation"`
+	Settings    *NodeSettings `json:"settings,omitempty"`
+	Forwards    []PortForward `json:"forwards,omitempty"`
+	// PeerExits maps a peer's address to its exit relay
+	PeerExits map[string]string `json:"peer_exits,omitempty"`
+}
+
+var stateFile string
+var stateMu sync.Mutex
+var history []RelaySwitch
+
+const maxHistory = 100
+
+func loadState() (NodeState, error) {
+	var state NodeState
+
+	stateBytes, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(stateBytes, &state)
+	return state, err
+}
+
+// saveState writes the state next to the mullvad configs so it survives container restarts
+func saveState() {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	s := getSettings()
+
+	relay, entry := currentRelay()
+
+	rotationMu.Lock()
+	state := NodeState{
+		ActiveRelay: relay,
+		ActiveEntry: entry,
+		History:     history,
+		Rotation:    rotation,
+		Settings:    &s,
+		Forwards:    getForwards(),
+		PeerExits:   getPeerExits(),
+	}
+	stateBytes, err := json.MarshalIndent(&state, "", "  ")
+	rotationMu.Unlock()
+	check(err)
+
+	tmp := stateFile + ".tmp"
+	err = os.MkdirAll(path.Dir(stateFile), 0700)
+	if err == nil {
+		err = os.WriteFile(tmp, stateBytes, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, stateFile)
+	}
+	if err != nil {
+		log.Printf("Failed to save state: %s\n", err)
+	}
+}
+
+func recordSwitch(from string, to string, entry string, reason string, err error) {
+	stateMu.Lock()
+	sw := RelaySwitch{From: from, To: to, Entry: entry, At: time.Now(), Reason: reason}
+	if err != nil {
+		sw.Error = err.Error()
+	}
+
+	history = append(history, sw)
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	stateMu.Unlock()
+
+	saveState()
+}
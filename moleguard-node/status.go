@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var startedAt = time.Now()
+
+type UpstreamStatus struct {
+	Interface     string     `json:"interface"`
+	Up            bool       `json:"up"`
+	LastHandshake *time.Time `json:"last_handshake"`
+}
+
+type ProbeStatus struct {
+	Last        *time.Time `json:"last"`
+	Ok          bool       `json:"ok"`
+	LastSuccess *time.Time `json:"last_success"`
+}
+
+type NodeStatus struct {
+	ActiveRelay string         `json:"active_relay"`
+	ActiveEntry string         `json:"active_entry,omitempty"`
+	Upstream    UpstreamStatus `json:"upstream"`
+	Probe       ProbeStatus    `json:"probe"`
+	Peers       int            `json:"peers"`
+	StartedAt   time.Time      `json:"started_at"`
+	Uptime      int64          `json:"uptime"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func interfaceUp(name string) bool {
+	if simulator != nil {
+		return simulator.interfaceUp(name)
+	}
+
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+
+	return intf.Flags&net.FlagUp != 0
+}
+
+// lastHandshake returns the most recent handshake of any peer on the interface
+func lastHandshake(intf string) time.Time {
+	out, err := output(wg, "show", intf, "latest-handshakes")
+	if err != nil {
+		return time.Time{}
+	}
+
+	var latest int64
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil && ts > latest {
+			latest = ts
+		}
+	}
+
+	if latest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(latest, 0)
+}
+
+func peerCount(intf string) int {
+	out, err := output(wg, "show", intf, "peers")
+	if err != nil {
+		return 0
+	}
+
+	return len(strings.Fields(string(out)))
+}
+
+func nodeStatus() NodeStatus {
+	probeMu.Lock()
+	probe := ProbeStatus{
+		Last:        optionalTime(lastProbe),
+		Ok:          lastProbeOk,
+		LastSuccess: optionalTime(lastProbeSuccess),
+	}
+	probeMu.Unlock()
+
+	relay, entry := currentRelay()
+
+	return NodeStatus{
+		ActiveRelay: relay,
+		ActiveEntry: entry,
+		Upstream: UpstreamStatus{
+			Interface:     relay,
+			Up:            interfaceUp(relay),
+			LastHandshake: optionalTime(lastHandshake(relay)),
+		},
+		Probe:     probe,
+		Peers:     peerCount("wg0"),
+		StartedAt: startedAt,
+		Uptime:    int64(time.Since(startedAt).Seconds()),
+	}
+}
+
+// ready reports whether the upstream is up and was reachable recently
+func ready() (bool, string) {
+	relay, _ := currentRelay()
+	if !interfaceUp(relay) {
+		return false, "upstream interface is down"
+	}
+
+	probeMu.Lock()
+	defer probeMu.Unlock()
+
+	if time.Since(lastProbeSuccess) > 30*time.Second {
+		return false, "no successful probe in the last 30s"
+	}
+
+	return true, "ok"
+}
@@ -1,16 +1,40 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path"
 	"sync"
+	"time"
 )
 
 var activeRelay string
+
+// activeEntry is the entry relay when the exit is reached through multihop
+var activeEntry string
 var wgMutex sync.Mutex
 
+// activeMu guards activeRelay and activeEntry, they change under wgMutex
+// but readers shouldn't have to wait for a relay switch to finish
+var activeMu sync.RWMutex
+
+// currentRelay returns the active relay and its entry relay
+func currentRelay() (string, string) {
+	activeMu.RLock()
+	defer activeMu.RUnlock()
+
+	return activeRelay, activeEntry
+}
+
+func setActiveRelay(relay string, entry string) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+
+	activeRelay, activeEntry = relay, entry
+}
+
 func downAll(confDir string) error {
 	files, err := os.ReadDir(confDir)
 	if err != nil {
@@ -18,93 +42,117 @@ func downAll(confDir string) error {
 	}
 
 	for _, file := range files {
-		_ = exec.Command(wgQuick, "down", path.Join(confDir, file.Name())).Run()
+		_ = quiet(wgQuick, "down", path.Join(confDir, file.Name()))
 	}
 
 	return nil
 }
 
-func iptablesSetup(newRelay string) error {
-	// Forwarding
-	if err := run(iptables, "-A", "FORWARD", "-o", "eth0@if20", "!", "-d", "10.13.13.1/24", "-j", "REJECT"); err != nil {
-		return err
-	}
-	if err := run(iptables, "-A", "FORWARD", "-i", newRelay, "-j", "ACCEPT"); err != nil {
-		return err
-	}
-	if err := run(iptables, "-A", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-		return err
-	}
-	if err := run(iptables, "-A", "FORWARD", "-j", "REJECT"); err != nil {
-		return err
+// upRelay brings up the exit relay, through the entry relay when one is given
+func upRelay(relay string, entry string) error {
+	if entry == "" {
+		return provider.Up(relay)
 	}
 
-	// NAT
-
-	if err := run("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "eth0@if20", "-j", "MASQUERADE"); err != nil {
-		return err
-	}
-	if err := run("iptables", "-t", "nat", "-A", "POSTROUTING", "-o", newRelay, "-j", "MASQUERADE"); err != nil {
-		return err
+	mp, ok := provider.(multihopProvider)
+	if !ok {
+		return errors.New("the upstream provider does not support multihop")
 	}
 
-	return nil
+	return mp.UpMultihop(relay, entry)
 }
 
-func iptablesTeardown(oldRelay string) error {
-	// Forwarding
-	if err := run(iptables, "-D", "FORWARD", "-o", "eth0@if20", "!", "-d", "10.13.13.1/24", "-j", "REJECT"); err != nil {
-		return err
+func validateMultihop(relay string, entry string) error {
+	if _, ok := provider.(multihopProvider); !ok {
+		return errors.New("the upstream provider does not support multihop")
 	}
-	if err := run(iptables, "-D", "FORWARD", "-i", oldRelay, "-j", "ACCEPT"); err != nil {
-		return err
-	}
-	if err := run(iptables, "-D", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-		return err
+	if relay == entry {
+		return errors.New("entry and exit relay must differ")
 	}
-	if err := run(iptables, "-D", "FORWARD", "-j", "REJECT"); err != nil {
-		return err
-	}
-
-	// NAT
 
-	if err := run("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", "eth0@if20", "-j", "MASQUERADE"); err != nil {
-		return err
+	exitInfo, ok := lookupRelay(relay)
+	if !ok {
+		return fmt.Errorf("unknown relay: %s", relay)
 	}
-	if err := run("iptables", "-t", "nat", "-D", "POSTROUTING", "-o", oldRelay, "-j", "MASQUERADE"); err != nil {
-		return err
+	if exitInfo.MultihopPort == 0 {
+		return fmt.Errorf("%s has no multihop port", relay)
+	}
+	if _, ok := lookupRelay(entry); !ok {
+		return fmt.Errorf("unknown relay: %s", entry)
 	}
 
 	return nil
 }
 
-func mullvadChange(relay string, confDir string) error {
+func relayChange(relay string, entry string, reason string) error {
 	wgMutex.Lock()
 	defer wgMutex.Unlock()
 
+	oldRelay, _ := currentRelay()
+	start := time.Now()
+	err := switchRelay(relay, entry)
+	observeRelaySwitch(time.Since(start), err)
+	recordSwitch(oldRelay, relay, entry, reason, err)
+
+	return err
+}
+
+func switchRelay(relay string, entry string) error {
+	postUpGen.Add(1)
+	pqUpgraded.Store(false)
+
 	log.Println("Tearing down old iptables rules")
-	err := iptablesTeardown(activeRelay)
+	err := iptablesTeardown()
+	if err != nil {
+		observeFirewallError("teardown")
+	}
 
-	log.Println("Disabling mullvad configs")
-	err = downAll(confDir)
+	log.Println("Disabling upstream tunnels")
+	err = provider.Down()
 	if err != nil {
 		return err
 	}
 
-	activeRelay = relay
+	setActiveRelay(relay, entry)
+
+	// an exit on the new relay gives way, its peers follow the active relay now
+	_, err = syncExits()
+	if err != nil {
+		log.Printf("Failed to update exits: %s\n", err)
+	}
 
 	log.Println("Setting up new iptables rules")
-	err = iptablesSetup(activeRelay)
+	err = iptablesSetup(relay)
 	if err != nil {
+		observeFirewallError("setup")
 		return err
 	}
 
-	log.Println("Enabling mullvad")
-	err = run(wgQuick, "up", path.Join(confDir, activeRelay+".conf"))
+	log.Println("Enabling upstream tunnel")
+	err = upRelay(relay, entry)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Upgrading tunnel to post quantum-tunnel")
-	return run(mullvadUpgradeTunnel, "-wg-interface", activeRelay)
+	startPostUp(relay)
+	return nil
+}
+
+// restoreRelay brings up the active relay and checks that it can reach the internet
+func restoreRelay() bool {
+	relay, entry := currentRelay()
+	if err := upRelay(relay, entry); err != nil {
+		return false
+	}
+	startPostUp(relay)
+
+	for i := 0; i < 3; i++ {
+		if netCheck() {
+			return true
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+
+	return false
 }